@@ -74,3 +74,16 @@ func testFile(t *testing.T, filename string) {
 func TestBoth(t *testing.T) {
 	testFile(t, "testdata/archlinux-2011.08.19-netinstall-i686.iso.torrent")
 }
+
+func TestBytes(t *testing.T) {
+	var s struct {
+		A Bytes `bencode:"a"`
+		B Bytes `bencode:"b,omitempty"`
+	}
+	require.NoError(t, Unmarshal([]byte("d1:ad1:xli1ei2eee1:ci3ee"), &s))
+	assert.EqualValues(t, "d1:xli1ei2eee", s.A)
+	assert.Nil(t, s.B)
+	b, err := Marshal(s)
+	require.NoError(t, err)
+	assert.EqualValues(t, "d1:ad1:xli1ei2eeee", b)
+}
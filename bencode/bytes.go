@@ -0,0 +1,20 @@
+package bencode
+
+// Bytes is a raw bencoded value. It's marshalled as is, and unmarshalled
+// without being parsed, so it can be decoded later or hashed exactly as it
+// was received.
+type Bytes []byte
+
+var (
+	_ Marshaler   = Bytes{}
+	_ Unmarshaler = &Bytes{}
+)
+
+func (me Bytes) MarshalBencode() ([]byte, error) {
+	return me, nil
+}
+
+func (me *Bytes) UnmarshalBencode(b []byte) error {
+	*me = append([]byte(nil), b...)
+	return nil
+}
@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// Canonical peer priority, per http://www.bittorrent.org/beps/bep_0040.html.
+// Both ends of a connection agree on it, so peers preferring high priority
+// connections form a well connected swarm.
+type peerPriority uint32
+
+var bep40Table = crc32.MakeTable(crc32.Castagnoli)
+
+// A mask to apply to IPs that share a prefix of the given number of bytes.
+type bep40Mask struct {
+	sharedPrefix int
+	mask         []byte
+}
+
+// Most specific first. For IPv6 only the first 8 bytes are used.
+var (
+	bep40Masks4 = []bep40Mask{
+		{3, []byte{0xff, 0xff, 0xff, 0xff}},
+		{2, []byte{0xff, 0xff, 0xff, 0x55}},
+		{0, []byte{0xff, 0xff, 0x55, 0x55}},
+	}
+	bep40Masks6 = []bep40Mask{
+		{6, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{4, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55}},
+		{0, []byte{0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55}},
+	}
+)
+
+// Returns the bytes that are hashed to give the priority of the connection
+// between the two endpoints.
+func bep40PriorityBytes(ip1 net.IP, port1 int, ip2 net.IP, port2 int) ([]byte, error) {
+	if ip1.Equal(ip2) {
+		var b [4]byte
+		binary.BigEndian.PutUint16(b[:2], uint16(port1))
+		binary.BigEndian.PutUint16(b[2:], uint16(port2))
+		if bytes.Compare(b[:2], b[2:]) > 0 {
+			binary.BigEndian.PutUint16(b[:2], uint16(port2))
+			binary.BigEndian.PutUint16(b[2:], uint16(port1))
+		}
+		return b[:], nil
+	}
+	var masks []bep40Mask
+	if a, b := ip1.To4(), ip2.To4(); a != nil && b != nil {
+		ip1, ip2 = a, b
+		masks = bep40Masks4
+	} else if a != nil || b != nil || ip1.To16() == nil || ip2.To16() == nil {
+		return nil, errors.New("incomparable IPs")
+	} else {
+		ip1, ip2 = ip1.To16(), ip2.To16()
+		masks = bep40Masks6
+	}
+	var m1, m2 []byte
+	for _, m := range masks {
+		if !bytes.Equal(ip1[:m.sharedPrefix], ip2[:m.sharedPrefix]) {
+			continue
+		}
+		m1 = make([]byte, len(m.mask))
+		m2 = make([]byte, len(m.mask))
+		for i, b := range m.mask {
+			m1[i] = ip1[i] & b
+			m2[i] = ip2[i] & b
+		}
+		break
+	}
+	if bytes.Compare(m1, m2) > 0 {
+		m1, m2 = m2, m1
+	}
+	return append(append([]byte(nil), m1...), m2...), nil
+}
+
+func bep40Priority(ip1 net.IP, port1 int, ip2 net.IP, port2 int) (peerPriority, error) {
+	b, err := bep40PriorityBytes(ip1, port1, ip2, port2)
+	if err != nil {
+		return 0, err
+	}
+	return peerPriority(crc32.Checksum(b, bep40Table)), nil
+}
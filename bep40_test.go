@@ -0,0 +1,38 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBEP40Priority(t *testing.T) {
+	prio := func(ip1 string, port1 int, ip2 string, port2 int) peerPriority {
+		ret, err := bep40Priority(net.ParseIP(ip1), port1, net.ParseIP(ip2), port2)
+		require.NoError(t, err)
+		// It's the same from either end.
+		other, err := bep40Priority(net.ParseIP(ip2), port2, net.ParseIP(ip1), port1)
+		require.NoError(t, err)
+		assert.Equal(t, ret, other)
+		return ret
+	}
+	// The examples from the BEP.
+	assert.EqualValues(t, 0xec2d7224, prio("123.213.32.10", 0, "98.76.54.32", 0))
+	assert.EqualValues(t, 0x99568189, prio("123.213.32.10", 0, "123.213.32.234", 0))
+	// Ports are used for the same IP.
+	assert.NotEqual(t, prio("1.2.3.4", 1, "1.2.3.4", 2), prio("1.2.3.4", 1, "1.2.3.4", 3))
+	prio("2001:db8::1", 0, "2001:db8::2", 0)
+	_, err := bep40Priority(net.ParseIP("1.2.3.4"), 0, net.ParseIP("2001:db8::1"), 0)
+	assert.Error(t, err)
+}
+
+func TestBEP40PriorityBytes(t *testing.T) {
+	b, err := bep40PriorityBytes(net.ParseIP("123.213.32.10"), 0, net.ParseIP("98.76.54.32"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x62, 0x4c, 0x14, 0x00, 0x7b, 0xd5, 0x00, 0x00}, b)
+	b, err = bep40PriorityBytes(net.ParseIP("1.2.3.4"), 2, net.ParseIP("1.2.3.4"), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 0, 2}, b)
+}
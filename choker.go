@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Tracks the optimistic unchoke for a torrent. The regular upload slots are
+// worked out from scratch each time.
+type choker struct {
+	optimistic *connection
+	// When the optimistic unchoke was last rotated.
+	optimisticRotated time.Time
+}
+
+// Periodically updates peer rates and reassigns upload slots until the
+// torrent is closed.
+func (t *Torrent) runChoker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed.LockedChan(&t.cl.mu):
+			return
+		case <-ticker.C:
+		}
+		t.cl.mu.Lock()
+		t.updateRates(chokeInterval)
+		t.rechoke()
+		t.cl.mu.Unlock()
+	}
+}
+
+func (t *Torrent) uploadSlots() int {
+	if n := t.cl.config.UploadSlots; n > 0 {
+		return n
+	}
+	return defaultUploadSlots
+}
+
+// Whether the torrent has anything to upload, and is willing to.
+func (t *Torrent) wantUpload() bool {
+	if t.cl.config.NoUpload {
+		return false
+	}
+	if !t.seeding() && !t.needData() {
+		// Uploading isn't altruistic by default.
+		return false
+	}
+	return t.haveAnyPieces()
+}
+
+// Orders connections by the rate that makes them deserving of an upload
+// slot, best first.
+type chokeRanking struct {
+	c       []*connection
+	seeding bool
+}
+
+func (me chokeRanking) Len() int      { return len(me.c) }
+func (me chokeRanking) Swap(i, j int) { me.c[i], me.c[j] = me.c[j], me.c[i] }
+
+func (me chokeRanking) rate(i int) float64 {
+	if me.seeding {
+		// Favour peers that take data fastest.
+		return me.c[i].uploadRate.Rate()
+	}
+	// Reciprocate to peers that give us the most.
+	return me.c[i].downloadRate.Rate()
+}
+
+func (me chokeRanking) Less(i, j int) bool {
+	return me.rate(i) > me.rate(j)
+}
+
+// Unchokes the best ranked peers, and one optimistic unchoke, and chokes
+// everyone else.
+func (t *Torrent) rechoke() {
+	var candidates []*connection
+	if t.wantUpload() {
+		for _, c := range t.conns {
+			if !c.closed.IsSet() && c.PeerInterested {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	sort.Stable(chokeRanking{candidates, t.seeding()})
+	unchoke := make(map[*connection]struct{}, t.uploadSlots())
+	for _, c := range candidates {
+		if len(unchoke) >= t.uploadSlots()-1 {
+			break
+		}
+		unchoke[c] = struct{}{}
+	}
+	t.updateOptimisticUnchoke(candidates, unchoke)
+	if c := t.choker.optimistic; c != nil {
+		unchoke[c] = struct{}{}
+	}
+	for _, c := range t.conns {
+		if _, ok := unchoke[c]; ok {
+			c.Unchoke()
+			t.cl.upload(t, c)
+		} else {
+			c.Choke()
+		}
+	}
+}
+
+// Keeps the optimistic unchoke if it's still valid and hasn't had its turn,
+// otherwise picks a random candidate not already unchoked.
+func (t *Torrent) updateOptimisticUnchoke(candidates []*connection, unchoked map[*connection]struct{}) {
+	ch := &t.choker
+	if ch.optimistic != nil && time.Since(ch.optimisticRotated) < optimisticUnchokeInterval {
+		if _, ok := unchoked[ch.optimistic]; !ok {
+			for _, c := range candidates {
+				if c == ch.optimistic {
+					return
+				}
+			}
+		}
+	}
+	ch.optimistic = nil
+	var others []*connection
+	for _, c := range candidates {
+		if _, ok := unchoked[c]; !ok {
+			others = append(others, c)
+		}
+	}
+	if len(others) == 0 {
+		return
+	}
+	ch.optimistic = others[rand.Intn(len(others))]
+	ch.optimisticRotated = time.Now()
+}
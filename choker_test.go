@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func TestRechoke(t *testing.T) {
+	tor := &Torrent{
+		cl:     &Client{},
+		info:   &metainfo.InfoEx{},
+		pieces: make([]piece, 2),
+	}
+	tor.completedPieces.Set(0, true)
+	// We still want piece 1.
+	tor.pendingPieces.Add(1)
+	for i := 0; i < 6; i++ {
+		tor.conns = append(tor.conns, &connection{
+			t:              tor,
+			Choked:         true,
+			PeerInterested: true,
+			downloadRate:   rollingRate{rate: float64(i)},
+		})
+	}
+	numUnchoked := func() (ret int) {
+		for _, c := range tor.conns {
+			if !c.Choked {
+				ret++
+			}
+		}
+		return
+	}
+	tor.rechoke()
+	assert.EqualValues(t, defaultUploadSlots, numUnchoked())
+	// The fastest peers get the regular slots.
+	for _, c := range tor.conns[3:] {
+		assert.False(t, c.Choked)
+	}
+	opt := tor.choker.optimistic
+	assert.NotNil(t, opt)
+	assert.True(t, opt.downloadRate.Rate() < 3)
+	// The optimistic unchoke stays put until its turn is over.
+	tor.rechoke()
+	assert.Equal(t, opt, tor.choker.optimistic)
+	// Losing interest frees the slot for another peer.
+	opt.PeerInterested = false
+	tor.rechoke()
+	assert.True(t, opt.Choked)
+	assert.NotEqual(t, opt, tor.choker.optimistic)
+	assert.EqualValues(t, defaultUploadSlots, numUnchoked())
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -24,11 +25,11 @@ import (
 	"github.com/anacrolix/sync"
 	"github.com/anacrolix/utp"
 	"github.com/dustin/go-humanize"
-	"github.com/juju/ratelimit"
 
 	"github.com/lovedboy/torrent/bencode"
 	"github.com/lovedboy/torrent/dht"
 	"github.com/lovedboy/torrent/dht/krpc"
+	"github.com/lovedboy/torrent/internal/ipvote"
 	"github.com/lovedboy/torrent/iplist"
 	"github.com/lovedboy/torrent/metainfo"
 	"github.com/lovedboy/torrent/mse"
@@ -68,6 +69,7 @@ type Client struct {
 	tcpListener    net.Listener
 	utpSock        *utp.Socket
 	dHT            *dht.Server
+	dHT6           *dht.Server // For IPv6 nodes, if dHT can't reach them.
 	ipBlockList    iplist.Ranger
 	config         Config
 	extensionBytes peerExtensionBytes
@@ -76,6 +78,12 @@ type Client struct {
 	// through legitimate channels.
 	dopplegangerAddrs map[string]struct{}
 	badPeerIPs        map[string]struct{}
+	// Values are PeerBan.
+	peerBans *pubsub.PubSub
+	// Our IP per the "yourip" field of peers' handshakes, once enough of
+	// them agree.
+	ipVotes    ipvote.Votes
+	reportedIP net.IP
 
 	defaultStorage storage.Client
 
@@ -85,7 +93,9 @@ type Client struct {
 
 	torrents map[metainfo.Hash]*Torrent
 
-	rate *ratelimit.Bucket
+	// Apply to piece data sent to and received from all peers.
+	uploadLimit   rateLimit
+	downloadLimit rateLimit
 
 	DisableAddPeer bool
 }
@@ -100,11 +110,37 @@ func (cl *Client) SetIPBlockList(list iplist.Ranger) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
 	cl.ipBlockList = list
-	if cl.dHT != nil {
-		cl.dHT.SetIPBlockList(list)
+	for _, s := range cl.dhtServers() {
+		s.SetIPBlockList(list)
 	}
 }
 
+// Sets the maximum bytes per second of piece data received from all peers.
+// Protocol overhead isn't counted. 0 or less removes the limit. Torrents can
+// have their own limits, which apply in addition to this one.
+func (cl *Client) SetDownloadRateLimit(bytesPerSecond int64) {
+	cl.downloadLimit.SetRate(bytesPerSecond)
+}
+
+// Returns the client-wide download limit in bytes per second, or 0 if there
+// is none.
+func (cl *Client) DownloadRateLimit() int64 {
+	return cl.downloadLimit.Rate()
+}
+
+// Sets the maximum bytes per second of piece data sent to all peers.
+// Protocol overhead isn't counted. 0 or less removes the limit. Torrents can
+// have their own limits, which apply in addition to this one.
+func (cl *Client) SetUploadRateLimit(bytesPerSecond int64) {
+	cl.uploadLimit.SetRate(bytesPerSecond)
+}
+
+// Returns the client-wide upload limit in bytes per second, or 0 if there is
+// none.
+func (cl *Client) UploadRateLimit() int64 {
+	return cl.uploadLimit.Rate()
+}
+
 func (cl *Client) PeerID() string {
 	return string(cl.peerID[:])
 }
@@ -164,11 +200,11 @@ func (cl *Client) WriteStatus(_w io.Writer) {
 	}
 	fmt.Fprintf(w, "Peer ID: %+q\n", cl.peerID)
 	fmt.Fprintf(w, "Banned IPs: %d\n", len(cl.badPeerIPs))
-	if cl.dHT != nil {
-		dhtStats := cl.dHT.Stats()
+	for _, s := range cl.dhtServers() {
+		dhtStats := s.Stats()
 		fmt.Fprintf(w, "DHT nodes: %d (%d good, %d banned)\n", dhtStats.Nodes, dhtStats.GoodNodes, dhtStats.BadNodes)
-		fmt.Fprintf(w, "DHT Server ID: %x\n", cl.dHT.ID())
-		fmt.Fprintf(w, "DHT port: %d\n", missinggo.AddrPort(cl.dHT.Addr()))
+		fmt.Fprintf(w, "DHT Server ID: %x\n", s.ID())
+		fmt.Fprintf(w, "DHT address: %s\n", s.Addr())
 		fmt.Fprintf(w, "DHT announces: %d\n", dhtStats.ConfirmedAnnounces)
 		fmt.Fprintf(w, "Outstanding transactions: %d\n", dhtStats.OutstandingTransactions)
 	}
@@ -275,6 +311,7 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 		defaultStorage:    cfg.DefaultStorage,
 		dopplegangerAddrs: make(map[string]struct{}),
 		torrents:          make(map[metainfo.Hash]*Torrent),
+		peerBans:          pubsub.NewPubSub(),
 	}
 	missinggo.CopyExact(&cl.extensionBytes, defaultExtensionBytes)
 	cl.event.L = &cl.mu
@@ -328,12 +365,55 @@ func NewClient(cfg *Config) (cl *Client, err error) {
 		if err != nil {
 			return
 		}
+		if !cfg.DisableIPv6 && !cl.dHT.CanReach(net.IPv6zero) {
+			cl.dHT6 = cl.newIPv6DHT(dhtCfg)
+		}
+	}
+
+	if cfg.UploadRateLimit != 0 {
+		cl.uploadLimit.SetRate(cfg.UploadRateLimit)
+	} else {
+		cl.uploadLimit.SetRate(cfg.SendPieceRate * 1024)
 	}
+	cl.downloadLimit.SetRate(cfg.DownloadRateLimit)
+
+	return
+}
 
-	if cfg.SendPieceRate > 0 {
-		cl.rate = ratelimit.NewBucketWithRate(float64(cfg.SendPieceRate*1024), cfg.SendPieceRate*1024)
+// Runs a DHT server on an IPv6 socket on the same port as the main one, per
+// http://www.bittorrent.org/beps/bep_0032.html. Failing to is not fatal, as
+// IPv6 may not be available.
+func (cl *Client) newIPv6DHT(cfg dht.ServerConfig) *dht.Server {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{
+		IP:   net.IPv6unspecified,
+		Port: missinggo.AddrPort(cl.dHT.Addr()),
+	})
+	if err != nil {
+		log.Printf("not running IPv6 DHT: %s", err)
+		return nil
+	}
+	cfg.Conn = conn
+	if cfg.PublicIP.To4() != nil {
+		cfg.PublicIP = nil
+	}
+	if cfg.StateFile != "" {
+		cfg.StateFile += ".ipv6"
+	}
+	s, err := dht.NewServer(&cfg)
+	if err != nil {
+		conn.Close()
+		log.Printf("not running IPv6 DHT: %s", err)
+		return nil
 	}
+	return s
+}
 
+func (cl *Client) dhtServers() (ret []*dht.Server) {
+	for _, s := range []*dht.Server{cl.dHT, cl.dHT6} {
+		if s != nil {
+			ret = append(ret, s)
+		}
+	}
 	return
 }
 
@@ -352,8 +432,8 @@ func (cl *Client) Close() {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
 	cl.closed.Set()
-	if cl.dHT != nil {
-		cl.dHT.Close()
+	for _, s := range cl.dhtServers() {
+		s.Close()
 	}
 	if cl.utpSock != nil {
 		cl.utpSock.Close()
@@ -364,6 +444,11 @@ func (cl *Client) Close() {
 	for _, t := range cl.torrents {
 		t.close()
 	}
+	if c, ok := cl.defaultStorage.(io.Closer); ok && cl.config.DefaultStorage == nil {
+		// We opened it, rather than the user.
+		c.Close()
+	}
+	cl.peerBans.Close()
 	cl.event.Broadcast()
 }
 
@@ -445,7 +530,7 @@ func (cl *Client) incomingConnection(nc net.Conn, utp bool) {
 		tc.SetLinger(0)
 	}
 	c := cl.newConnection(nc)
-	c.Discovery = peerSourceIncoming
+	c.Discovery = PeerSourceIncoming
 	c.uTP = utp
 	cl.runReceivedConn(c)
 }
@@ -636,7 +721,7 @@ func (cl *Client) establishOutgoingConn(t *Torrent, addr string) (c *connection,
 
 // Called to dial out and run a connection. The addr we're given is already
 // considered half-open.
-func (cl *Client) outgoingConnection(t *Torrent, addr string, ps peerSource) {
+func (cl *Client) outgoingConnection(t *Torrent, addr string, ps PeerSource) {
 	c, err := cl.establishOutgoingConn(t, addr)
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
@@ -1085,41 +1170,30 @@ func (cl *Client) gotMetadataExtensionMsg(payload []byte, t *Torrent, c *connect
 	return
 }
 
+// Sends the chunks requested by an unchoked peer. Upload slots are handed out
+// by the choker.
 func (cl *Client) upload(t *Torrent, c *connection) {
-	if cl.config.NoUpload {
+	if c.Choked {
 		return
 	}
-	if !c.PeerInterested {
-		return
-	}
-	seeding := t.seeding()
-	if !seeding && !t.connHasWantedPieces(c) {
-		return
-	}
-another:
-	for seeding || c.chunksSent < c.UsefulChunksReceived+6 {
-		c.Unchoke()
-		for r := range c.PeerRequests {
-			err := cl.sendChunk(t, c, r)
-			if err != nil {
-				if t.pieceComplete(int(r.Index)) && err == io.ErrUnexpectedEOF {
-					// We had the piece, but not anymore.
-				} else {
-					log.Printf("error sending chunk %+v to peer: %s", r, err)
-				}
-				// If we failed to send a chunk, choke the peer to ensure they
-				// flush all their requests. We've probably dropped a piece,
-				// but there's no way to communicate this to the peer. If they
-				// ask for it again, we'll kick them to allow us to send them
-				// an updated bitfield.
-				break another
+	for r := range c.PeerRequests {
+		err := cl.sendChunk(t, c, r)
+		if err != nil {
+			if t.pieceComplete(int(r.Index)) && err == io.ErrUnexpectedEOF {
+				// We had the piece, but not anymore.
+			} else {
+				log.Printf("error sending chunk %+v to peer: %s", r, err)
 			}
-			delete(c.PeerRequests, r)
-			goto another
+			// If we failed to send a chunk, choke the peer to ensure they
+			// flush all their requests. We've probably dropped a piece, but
+			// there's no way to communicate this to the peer. If they ask for
+			// it again, we'll kick them to allow us to send them an updated
+			// bitfield.
+			c.Choke()
+			return
 		}
-		return
+		delete(c.PeerRequests, r)
 	}
-	c.Choke()
 }
 
 func (cl *Client) sendChunk(t *Torrent, c *connection, r request) error {
@@ -1148,21 +1222,29 @@ func (cl *Client) sendChunk(t *Torrent, c *connection, r request) error {
 // Processes incoming bittorrent messages. The client lock is held upon entry
 // and exit. Returning will end the connection.
 func (cl *Client) connectionLoop(t *Torrent, c *connection) error {
+	cr := &countingReader{r: c.rw}
 	decoder := pp.Decoder{
-		R:         bufio.NewReader(c.rw),
+		R:         bufio.NewReader(cr),
 		MaxLength: 256 * 1024,
 	}
 	for {
 		cl.mu.Unlock()
 		var msg pp.Message
 		err := decoder.Decode(&msg)
+		if err == nil && !msg.Keepalive && msg.Type == pp.Piece {
+			// Hold off reading further until the payload is within limits.
+			waitRateLimits(int64(len(msg.Piece)), &cl.downloadLimit, &t.downloadLimit)
+		}
 		cl.mu.Lock()
+		c.readBytes(cr.n)
+		cr.n = 0
 		if cl.closed.IsSet() || c.closed.IsSet() || err == io.EOF {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
+		c.readMsg(&msg)
 		c.lastMessageReceived = time.Now()
 		if msg.Keepalive {
 			receivedKeepalives.Add(1)
@@ -1183,10 +1265,10 @@ func (cl *Client) connectionLoop(t *Torrent, c *connection) error {
 			cl.peerUnchoked(t, c)
 		case pp.Interested:
 			c.PeerInterested = true
-			cl.upload(t, c)
+			t.rechoke()
 		case pp.NotInterested:
 			c.PeerInterested = false
-			c.Choke()
+			t.rechoke()
 		case pp.Have:
 			err = c.peerSentHave(int(msg.Index))
 		case pp.Request:
@@ -1242,6 +1324,12 @@ func (cl *Client) connectionLoop(t *Torrent, c *connection) error {
 				if v, ok := d["v"]; ok {
 					c.PeerClientName = v.(string)
 				}
+				if p, ok := d["p"].(int64); ok {
+					c.PeerListenPort = int(p)
+				}
+				if yourip, ok := d["yourip"].(string); ok && (len(yourip) == 4 || len(yourip) == 16) {
+					cl.voteReportedIP(missinggo.AddrIP(c.remoteAddr()), net.IP(yourip))
+				}
 				m, ok := d["m"]
 				if !ok {
 					err = errors.New("handshake missing m item")
@@ -1303,21 +1391,7 @@ func (cl *Client) connectionLoop(t *Torrent, c *connection) error {
 				}
 				go func() {
 					cl.mu.Lock()
-					cl.addPeers(t, func() (ret []Peer) {
-						for i, cp := range pexMsg.Added {
-							p := Peer{
-								IP:     make([]byte, 4),
-								Port:   cp.Port,
-								Source: peerSourcePEX,
-							}
-							if i < len(pexMsg.AddedFlags) && pexMsg.AddedFlags[i]&0x01 != 0 {
-								p.SupportsEncryption = true
-							}
-							missinggo.CopyExact(p.IP, cp.IP[:])
-							ret = append(ret, p)
-						}
-						return
-					}())
+					cl.addPeers(t, pexMsg.addedPeers())
 					cl.mu.Unlock()
 				}()
 			default:
@@ -1342,7 +1416,12 @@ func (cl *Client) connectionLoop(t *Torrent, c *connection) error {
 			if msg.Port != 0 {
 				pingAddr.Port = int(msg.Port)
 			}
-			cl.dHT.Ping(pingAddr)
+			for _, s := range cl.dhtServers() {
+				if s.CanReach(pingAddr.IP) {
+					go s.Ping(context.Background(), pingAddr)
+					break
+				}
+			}
 		default:
 			err = fmt.Errorf("received unknown message type: %#v", msg.Type)
 		}
@@ -1367,7 +1446,7 @@ func (cl *Client) addConnection(t *Torrent, c *connection) bool {
 			return false
 		}
 	}
-	if len(t.conns) >= socketsPerTorrent {
+	if t.numPeerConns() >= socketsPerTorrent {
 		c := t.worstBadConn(cl)
 		if c == nil {
 			return false
@@ -1378,8 +1457,8 @@ func (cl *Client) addConnection(t *Torrent, c *connection) bool {
 		c.Close()
 		t.deleteConnection(c)
 	}
-	if len(t.conns) >= socketsPerTorrent {
-		panic(len(t.conns))
+	if t.numPeerConns() >= socketsPerTorrent {
+		panic(t.numPeerConns())
 	}
 	t.conns = append(t.conns, c)
 	c.t = t
@@ -1403,7 +1482,7 @@ func (cl *Client) wantConns(t *Torrent) bool {
 	if !t.seeding() && !t.needData() {
 		return false
 	}
-	if len(t.conns) < socketsPerTorrent {
+	if t.numPeerConns() < socketsPerTorrent {
 		return true
 	}
 	return t.worstBadConn(cl) != nil
@@ -1418,18 +1497,65 @@ func (cl *Client) openNewConns(t *Torrent) {
 		if len(t.halfOpen) >= cl.halfOpenLimit {
 			return
 		}
-		var (
-			k peersKey
-			p Peer
-		)
-		for k, p = range t.peers {
-			break
-		}
+		k, p := cl.bestPeer(t)
 		delete(t.peers, k)
 		cl.initiateConn(p, t)
 	}
 }
 
+// Returns the queued peer with the highest BEP 40 priority.
+func (cl *Client) bestPeer(t *Torrent) (bestKey peersKey, best Peer) {
+	// Finding our IP can involve the DHT servers, so it's done once up front.
+	ourIP, ourPort := cl.publicIP(), cl.incomingPeerPort()
+	var bestPrio peerPriority
+	first := true
+	for k, p := range t.peers {
+		prio, _ := bep40Priority(ourIP, ourPort, p.IP, p.Port)
+		if first || prio > bestPrio {
+			bestKey, best, bestPrio = k, p, prio
+			first = false
+		}
+	}
+	return
+}
+
+// Counts the IP a peer reports seeing us at. A single peer can't change our
+// IP, as it could be lying.
+func (cl *Client) voteReportedIP(voter, ip net.IP) {
+	if voter == nil || (ip.To4() == nil) != (voter.To4() == nil) {
+		// Our address in another family says nothing about this connection.
+		return
+	}
+	now := time.Now()
+	cl.ipVotes.Vote(voter, ip, now)
+	if w := cl.ipVotes.Winner(cl.reportedIP, now); w != nil {
+		cl.reportedIP = w
+	}
+}
+
+// Our IP as peers see it, or nil if it's not known.
+func (cl *Client) publicIP() net.IP {
+	if cl.config.PublicIP != nil {
+		return cl.config.PublicIP
+	}
+	// Voted by many DHT nodes, so more trustworthy than a single peer.
+	for _, s := range cl.dhtServers() {
+		if ip := s.PublicIP(); ip != nil {
+			return ip
+		}
+	}
+	if cl.reportedIP != nil {
+		return cl.reportedIP
+	}
+	if cl.listenAddr != "" {
+		ip := missinggo.AddrIP(cl.ListenAddr())
+		if ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return nil
+}
+
 func (cl *Client) badPeerIPPort(ip net.IP, port int) bool {
 	if port == 0 {
 		return true
@@ -1437,6 +1563,9 @@ func (cl *Client) badPeerIPPort(ip net.IP, port int) bool {
 	if cl.dopplegangerAddr(net.JoinHostPort(ip.String(), strconv.FormatInt(int64(port), 10))) {
 		return true
 	}
+	if ip.To4() == nil && cl.config.DisableIPv6 {
+		return true
+	}
 	if _, ok := cl.ipBlockRange(ip); ok {
 		return true
 	}
@@ -1511,6 +1640,12 @@ type TorrentSpec struct {
 	// set.
 	ChunkSize int
 	Storage   storage.Client
+	// BEP 19 web seed URLs.
+	Webseeds []string
+	// BEP 17 HTTP seed URLs.
+	HTTPSeeds []string
+	// State from a previous session, as returned by Torrent.ResumeData.
+	ResumeData *ResumeData
 }
 
 func TorrentSpecFromMagnetURI(uri string) (spec *TorrentSpec, err error) {
@@ -1532,6 +1667,8 @@ func TorrentSpecFromMetaInfo(mi *metainfo.MetaInfo) (spec *TorrentSpec) {
 		Info:        &mi.Info,
 		DisplayName: mi.Info.Name,
 		InfoHash:    mi.Info.Hash(),
+		Webseeds:    mi.URLList,
+		HTTPSeeds:   mi.HTTPSeeds,
 	}
 	if spec.Trackers == nil && mi.Announce != "" {
 		spec.Trackers = [][]string{{mi.Announce}}
@@ -1548,8 +1685,10 @@ func (cl *Client) AddTorrentInfoHash(infoHash metainfo.Hash) (t *Torrent, new bo
 	}
 	new = true
 	t = cl.newTorrent(infoHash)
-	if cl.dHT != nil {
-		go cl.announceTorrentDHT(t, true)
+	go t.runChoker()
+	go t.runPEX()
+	for _, s := range cl.dhtServers() {
+		go cl.announceTorrentDHT(t, s, true)
 	}
 	cl.torrents[infoHash] = t
 	t.updateWantPeersEvent()
@@ -1577,6 +1716,14 @@ func (cl *Client) AddTorrentSpec(spec *TorrentSpec) (t *Torrent, new bool, err e
 		t.chunkSize = pp.Integer(spec.ChunkSize)
 	}
 	t.addTrackers(spec.Trackers)
+	t.addWebSeeds(spec.Webseeds)
+	t.addHTTPSeeds(spec.HTTPSeeds)
+	if spec.ResumeData != nil {
+		err = t.setResumeData(spec.ResumeData)
+		if err != nil {
+			return
+		}
+	}
 	t.maybeNewConns()
 	return
 }
@@ -1620,7 +1767,7 @@ func (cl *Client) CheckExistsInfoHash(infoHash metainfo.Hash) (ok bool) {
 	return ok
 }
 
-func (cl *Client) announceTorrentDHT(t *Torrent, impliedPort bool) {
+func (cl *Client) announceTorrentDHT(t *Torrent, s *dht.Server, impliedPort bool) {
 	for {
 		select {
 		case <-t.wantPeersEvent.LockedChan(&cl.mu):
@@ -1628,7 +1775,7 @@ func (cl *Client) announceTorrentDHT(t *Torrent, impliedPort bool) {
 			return
 		}
 		// log.Printf("getting peers for %q from DHT", t)
-		ps, err := cl.dHT.Announce(string(t.infoHash[:]), cl.incomingPeerPort(), impliedPort)
+		ps, err := s.Announce(string(t.infoHash[:]), cl.incomingPeerPort(), impliedPort)
 		if err != nil {
 			log.Printf("error getting peers from dht: %s", err)
 			return
@@ -1651,7 +1798,7 @@ func (cl *Client) announceTorrentDHT(t *Torrent, impliedPort bool) {
 					addPeers = append(addPeers, Peer{
 						IP:     cp.IP[:],
 						Port:   cp.Port,
-						Source: peerSourceDHT,
+						Source: PeerSourceDHT,
 					})
 					key := (&net.UDPAddr{
 						IP:   cp.IP[:],
@@ -1792,6 +1939,9 @@ func (cl *Client) downloadedChunk(t *Torrent, c *connection, msg *pp.Message) {
 		c.peerTouchedPieces = make(map[int]struct{})
 	}
 	c.peerTouchedPieces[index] = struct{}{}
+	if c.webSeed == nil {
+		t.smartBan.record(index, chunkIndex(req.chunkSpec, t.chunkSize), missinggo.AddrIP(c.remoteAddr()), msg.Piece)
+	}
 
 	cl.event.Broadcast()
 	t.publishPieceChange(int(req.Index))
@@ -1810,7 +1960,9 @@ func (cl *Client) reapPieceTouches(t *Torrent, piece int) (ret []*connection) {
 	return
 }
 
-func (cl *Client) pieceHashed(t *Torrent, piece int, correct bool) {
+// chunkHashes are the hashes of the piece's chunks, if they were wanted by the
+// smart ban.
+func (cl *Client) pieceHashed(t *Torrent, piece int, correct bool, chunkHashes []metainfo.Hash) {
 	p := &t.pieces[piece]
 	if p.EverHashed {
 		// Don't score the first time a piece is hashed, it could be an
@@ -1824,21 +1976,37 @@ func (cl *Client) pieceHashed(t *Torrent, piece int, correct bool) {
 	}
 	p.EverHashed = true
 	touchers := cl.reapPieceTouches(t, piece)
+	var culprits []net.IP
 	if correct {
 		for _, c := range touchers {
 			c.goodPiecesDirtied++
 		}
+		culprits = t.smartBan.piecePassed(piece, chunkHashes)
 		err := p.Storage().MarkComplete()
 		if err != nil {
 			log.Printf("%T: error completing piece %d: %s", t.storage, piece, err)
 		}
 		t.updatePieceCompletion(piece)
-	} else if len(touchers) != 0 {
-		log.Printf("dropping and banning %d conns that touched piece", len(touchers))
+	} else {
 		for _, c := range touchers {
 			c.badPiecesDirtied++
-			t.cl.banPeerIP(missinggo.AddrIP(c.remoteAddr()))
-			t.dropConnection(c)
+		}
+		// The blame is only certain if one peer sent everything, otherwise
+		// it waits until the piece passes.
+		culprits = t.smartBan.pieceFailed(piece, p.numChunks())
+	}
+	for _, ip := range culprits {
+		log.Printf("%s: banning %s for sending bad data for piece %d", t, ip, piece)
+		cl.banPeerIP(ip)
+		cl.peerBans.Publish(PeerBan{
+			IP:       ip,
+			InfoHash: t.infoHash,
+			Piece:    piece,
+		})
+		for _, c := range append([]*connection(nil), t.conns...) {
+			if c.webSeed == nil && missinggo.AddrIP(c.remoteAddr()).Equal(ip) {
+				t.dropConnection(c)
+			}
 		}
 	}
 	cl.pieceChanged(t, piece)
@@ -1855,10 +2023,9 @@ func (cl *Client) onCompletedPiece(t *Torrent, piece int) {
 				conn.Cancel(r)
 			}
 		}
-		// Could check here if peer doesn't have piece, but due to caching
-		// some peers may have said they have a piece but they don't.
-		cl.upload(t, conn)
 	}
+	// We may have something to upload now.
+	t.rechoke()
 }
 
 func (cl *Client) onFailedPiece(t *Torrent, piece int) {
@@ -1905,11 +2072,12 @@ func (cl *Client) verifyPiece(t *Torrent, piece int) {
 	}
 	p.Hashing = true
 	t.publishPieceChange(piece)
+	wantChunkHashes := t.smartBan.wantChunkHashes(piece)
 	cl.mu.Unlock()
-	sum := t.hashPiece(piece)
+	sum, chunkHashes := t.hashPiece(piece, wantChunkHashes)
 	cl.mu.Lock()
 	p.Hashing = false
-	cl.pieceHashed(t, piece, sum == p.Hash)
+	cl.pieceHashed(t, piece, sum == p.Hash, chunkHashes)
 }
 
 // Returns handles to all the torrents loaded in the Client.
@@ -1951,6 +2119,11 @@ func (cl *Client) DHT() *dht.Server {
 	return cl.dHT
 }
 
+// Returns the DHT server for IPv6 nodes, if DHT() can't reach them itself.
+func (cl *Client) DHT6() *dht.Server {
+	return cl.dHT6
+}
+
 func (cl *Client) AddDHTNodes(nodes []string) {
 	for _, n := range nodes {
 		hmp := missinggo.SplitHostMaybePort(n)
@@ -1965,10 +2138,19 @@ func (cl *Client) AddDHTNodes(nodes []string) {
 				Port: hmp.Port,
 			},
 		}
-		cl.DHT().AddNode(ni)
+		// Servers ignore nodes they can't reach.
+		for _, s := range cl.dhtServers() {
+			s.AddNode(ni)
+		}
 	}
 }
 
+// The subscription emits a PeerBan each time a peer is banned for sending bad
+// piece data.
+func (cl *Client) SubscribePeerBans() *pubsub.Subscription {
+	return cl.peerBans.Subscribe()
+}
+
 func (cl *Client) banPeerIP(ip net.IP) {
 	if cl.badPeerIPs == nil {
 		cl.badPeerIPs = make(map[string]struct{})
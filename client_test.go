@@ -26,6 +26,7 @@ import (
 
 	"github.com/lovedboy/torrent/bencode"
 	"github.com/lovedboy/torrent/dht"
+	"github.com/lovedboy/torrent/internal/ipvote"
 	"github.com/lovedboy/torrent/internal/testutil"
 	"github.com/lovedboy/torrent/iplist"
 	"github.com/lovedboy/torrent/metainfo"
@@ -938,3 +939,126 @@ func TestClientDynamicListenPortNoProtocols(t *testing.T) {
 	t.Log(cl.listenAddr)
 	assert.Nil(t, cl.ListenAddr())
 }
+
+func TestResumeDataBeforeGotInfo(t *testing.T) {
+	cl, err := NewClient(&TestingConfig)
+	require.NoError(t, err)
+	defer cl.Close()
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	rd := ResumeData{
+		InfoHash:      mi.Info.Hash(),
+		ChunkSize:     2,
+		Pieces:        []ResumePiece{{Index: 1, DirtyChunks: []int{0, 2}}},
+		PendingPieces: []int{2},
+		Trackers:      [][]string{{"http://a"}},
+	}
+	b, err := bencode.Marshal(rd)
+	require.NoError(t, err)
+	var rd2 ResumeData
+	require.NoError(t, bencode.Unmarshal(b, &rd2))
+	require.EqualValues(t, rd, rd2)
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:   mi.Info.Hash(),
+		ChunkSize:  2,
+		ResumeData: &rd2,
+	})
+	require.NoError(t, err)
+	// Without the info, the resume data is carried over unchanged.
+	assert.EqualValues(t, rd.Pieces, tt.ResumeData().Pieces)
+	_, _, err = cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	require.NoError(t, err)
+	assert.True(t, tt.PieceState(1).Partial)
+	assert.EqualValues(t, PiecePriorityNormal, tt.PieceState(2).Priority)
+	rd2 = tt.ResumeData()
+	assert.EqualValues(t, rd.Pieces, rd2.Pieces)
+	assert.EqualValues(t, rd.PendingPieces, rd2.PendingPieces)
+	assert.EqualValues(t, rd.Trackers, rd2.Trackers)
+}
+
+func TestResumeDataWrongInfoHash(t *testing.T) {
+	cl, err := NewClient(&TestingConfig)
+	require.NoError(t, err)
+	defer cl.Close()
+	_, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		InfoHash:   metainfo.Hash{1},
+		ResumeData: &ResumeData{InfoHash: metainfo.Hash{2}},
+	})
+	assert.Error(t, err)
+}
+
+func TestResumeDataFilePriorities(t *testing.T) {
+	cl, err := NewClient(&TestingConfig)
+	require.NoError(t, err)
+	defer cl.Close()
+	ie := metainfo.InfoEx{
+		Info: metainfo.Info{
+			Name:        "a",
+			PieceLength: 5,
+			Pieces:      make([]byte, 40),
+			Files: []metainfo.FileInfo{
+				{Path: []string{"b"}, Length: 5},
+				{Path: []string{"c"}, Length: 5},
+				{Path: []string{"d"}, Length: 10},
+			},
+		},
+	}
+	ie.UpdateBytes()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		Info:     &ie,
+		InfoHash: ie.Hash(),
+	})
+	require.NoError(t, err)
+	tt.DownloadAll()
+	files := tt.Files()
+	files[0].Cancel()
+	files[1].Download()
+	rd := tt.ResumeData()
+	assert.EqualValues(t, []ResumeFile{
+		{0, FilePriorityNone},
+		{1, FilePriorityNormal},
+	}, rd.Files)
+	tt.Drop()
+	b, err := bencode.Marshal(rd)
+	require.NoError(t, err)
+	var rd2 ResumeData
+	require.NoError(t, bencode.Unmarshal(b, &rd2))
+	require.EqualValues(t, rd, rd2)
+	tt, _, err = cl.AddTorrentSpec(&TorrentSpec{
+		Info:       &ie,
+		InfoHash:   ie.Hash(),
+		ResumeData: &rd2,
+	})
+	require.NoError(t, err)
+	files = tt.Files()
+	assert.EqualValues(t, FilePriorityNone, files[0].Priority())
+	assert.EqualValues(t, FilePriorityNormal, files[1].Priority())
+	assert.EqualValues(t, FilePriorityDefault, files[2].Priority())
+	assert.EqualValues(t, PiecePriorityNone, tt.PieceState(0).Priority)
+	assert.EqualValues(t, PiecePriorityNormal, tt.PieceState(1).Priority)
+	// Files left out stay out of DownloadAll.
+	tt.DownloadAll()
+	assert.EqualValues(t, PiecePriorityNone, tt.PieceState(0).Priority)
+	assert.EqualValues(t, PiecePriorityNormal, tt.PieceState(3).Priority)
+}
+
+func TestReportedIPNeedsAgreement(t *testing.T) {
+	cl, err := NewClient(&TestingConfig)
+	require.NoError(t, err)
+	defer cl.Close()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	ip := net.IPv4(93, 184, 216, 34).To4()
+	// A single peer can't set our IP, however often it reports it.
+	for i := 0; i < ipvote.MinVotes; i++ {
+		cl.voteReportedIP(net.IPv4(1, 1, 1, 1), net.IPv4(6, 6, 6, 6))
+	}
+	assert.Nil(t, cl.reportedIP)
+	for i := 0; i < ipvote.MinVotes; i++ {
+		voter := net.IPv4(1, 1, 2, byte(i))
+		// Reports in the other address family are ignored.
+		cl.voteReportedIP(voter, net.ParseIP("2001:db8::1"))
+		cl.voteReportedIP(voter, ip)
+	}
+	assert.True(t, ip.Equal(cl.reportedIP))
+}
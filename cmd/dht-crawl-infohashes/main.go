@@ -0,0 +1,159 @@
+// Crawls the DHT with sample_infohashes queries, printing each infohash
+// discovered in hex.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	_ "github.com/anacrolix/envpprof"
+
+	"github.com/lovedboy/torrent/dht"
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+var (
+	tableFileName = flag.String("tableFile", "", "name of file for storing the node ID and table")
+	serveAddr     = flag.String("serveAddr", ":0", "local UDP address")
+	parallel      = flag.Int("parallel", 20, "maximum outstanding queries")
+
+	s        *dht.Server
+	quitting = make(chan struct{})
+)
+
+// Nodes that don't say how long to wait before querying them again aren't
+// queried again until this has passed.
+const defaultRequeryInterval = 10 * time.Minute
+
+// The most nodes waiting to be queried.
+const maxPendingNodes = 10000
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Parse()
+	var err error
+	s, err = dht.NewServer(&dht.ServerConfig{
+		Addr:      *serveAddr,
+		StateFile: *tableFileName,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("dht server on %s, ID is %x", s.Addr(), s.ID())
+	setupSignals()
+}
+
+func setupSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		close(quitting)
+	}()
+}
+
+type response struct {
+	addr string
+	r    *krpc.Return
+	err  error
+}
+
+type crawler struct {
+	seen        map[[20]byte]struct{}
+	nextQuery   map[string]time.Time // By node address.
+	pending     []krpc.NodeInfo
+	outstanding int
+	responses   chan response
+	numQueried  int
+	numReplied  int
+}
+
+func (c *crawler) addNodes(nis []krpc.NodeInfo) {
+	for _, ni := range nis {
+		if len(c.pending) >= maxPendingNodes {
+			return
+		}
+		if ni.Addr == nil || ni.Addr.Port == 0 {
+			continue
+		}
+		if time.Now().Before(c.nextQuery[ni.Addr.String()]) {
+			continue
+		}
+		c.pending = append(c.pending, ni)
+	}
+}
+
+func (c *crawler) queryNext() {
+	ni := c.pending[0]
+	c.pending = c.pending[1:]
+	addr := ni.Addr.String()
+	if time.Now().Before(c.nextQuery[addr]) {
+		return
+	}
+	c.nextQuery[addr] = time.Now().Add(defaultRequeryInterval)
+	// Random targets spread the walk over the keyspace.
+	var target [20]byte
+	rand.Read(target[:])
+	c.outstanding++
+	c.numQueried++
+	go func() {
+		r, err := s.SampleInfohashes(context.Background(), ni.Addr, string(target[:]))
+		c.responses <- response{addr, r, err}
+	}()
+}
+
+func (c *crawler) handleResponse(r response) {
+	c.outstanding--
+	if r.err != nil {
+		return
+	}
+	c.numReplied++
+	if r.r.Interval != 0 {
+		c.nextQuery[r.addr] = time.Now().Add(time.Duration(r.r.Interval) * time.Second)
+	}
+	for _, ih := range r.r.Samples {
+		if _, ok := c.seen[ih]; ok {
+			continue
+		}
+		c.seen[ih] = struct{}{}
+		fmt.Printf("%x\n", ih)
+	}
+	c.addNodes(r.r.AllNodes())
+}
+
+func main() {
+	c := crawler{
+		seen:      make(map[[20]byte]struct{}),
+		nextQuery: make(map[string]time.Time),
+		// Buffered so the queries never block after the crawl stops.
+		responses: make(chan response, *parallel),
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+crawl:
+	for {
+		for c.outstanding < *parallel && len(c.pending) != 0 {
+			c.queryNext()
+		}
+		select {
+		case r := <-c.responses:
+			c.handleResponse(r)
+		case <-tick.C:
+			// Restart from the routing table if the walk runs dry.
+			if len(c.pending) == 0 {
+				c.addNodes(s.Nodes())
+			}
+		case <-quitting:
+			break crawl
+		}
+	}
+	log.Printf("%d infohashes from %d/%d nodes", len(c.seen), c.numReplied, c.numQueried)
+	// This saves the table file.
+	s.Close()
+}
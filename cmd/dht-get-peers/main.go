@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -12,11 +11,10 @@ import (
 	_ "github.com/anacrolix/envpprof"
 
 	"github.com/lovedboy/torrent/dht"
-	"github.com/lovedboy/torrent/dht/krpc"
 )
 
 var (
-	tableFileName = flag.String("tableFile", "", "name of file for storing node info")
+	tableFileName = flag.String("tableFile", "", "name of file for storing the node ID and table")
 	serveAddr     = flag.String("serveAddr", ":0", "local UDP address")
 	infoHash      = flag.String("infoHash", "", "torrent infohash")
 	once          = flag.Bool("once", false, "only do one scrape iteration")
@@ -25,40 +23,6 @@ var (
 	quitting = make(chan struct{})
 )
 
-func loadTable() error {
-	if *tableFileName == "" {
-		return nil
-	}
-	f, err := os.Open(*tableFileName)
-	if os.IsNotExist(err) {
-		return nil
-	}
-	if err != nil {
-		return fmt.Errorf("error opening table file: %s", err)
-	}
-	defer f.Close()
-	added := 0
-	for {
-		b := make([]byte, krpc.CompactIPv4NodeInfoLen)
-		_, err := io.ReadFull(f, b)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading table file: %s", err)
-		}
-		var ni krpc.NodeInfo
-		err = ni.UnmarshalCompactIPv4(b)
-		if err != nil {
-			return fmt.Errorf("error unmarshaling compact node info: %s", err)
-		}
-		s.AddNode(ni)
-		added++
-	}
-	log.Printf("loaded %d nodes from table file", added)
-	return nil
-}
-
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
@@ -74,47 +38,16 @@ func init() {
 	}
 	var err error
 	s, err = dht.NewServer(&dht.ServerConfig{
-		Addr: *serveAddr,
+		Addr:      *serveAddr,
+		StateFile: *tableFileName,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = loadTable()
-	if err != nil {
-		log.Fatalf("error loading table: %s", err)
-	}
 	log.Printf("dht server on %s, ID is %x", s.Addr(), s.ID())
 	setupSignals()
 }
 
-func saveTable() error {
-	goodNodes := s.Nodes()
-	if *tableFileName == "" {
-		if len(goodNodes) != 0 {
-			log.Print("good nodes were discarded because you didn't specify a table file")
-		}
-		return nil
-	}
-	f, err := os.OpenFile(*tableFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
-	if err != nil {
-		return fmt.Errorf("error opening table file: %s", err)
-	}
-	defer f.Close()
-	for _, nodeInfo := range goodNodes {
-		var b [krpc.CompactIPv4NodeInfoLen]byte
-		err := nodeInfo.PutCompact(b[:])
-		if err != nil {
-			return fmt.Errorf("error compacting node info: %s", err)
-		}
-		_, err = f.Write(b[:])
-		if err != nil {
-			return fmt.Errorf("error writing compact node info: %s", err)
-		}
-	}
-	log.Printf("saved %d nodes to table file", len(goodNodes))
-	return nil
-}
-
 func setupSignals() {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, os.Interrupt)
@@ -128,7 +61,7 @@ func main() {
 	seen := make(map[string]struct{})
 getPeers:
 	for {
-		ps, err := s.Announce(*infoHash, 0, false)
+		ps, err := s.GetPeers(*infoHash)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -158,7 +91,6 @@ getPeers:
 			break
 		}
 	}
-	if err := saveTable(); err != nil {
-		log.Printf("error saving node table: %s", err)
-	}
+	// This saves the table file.
+	s.Close()
 }
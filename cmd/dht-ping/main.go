@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -13,7 +14,6 @@ import (
 	"github.com/bradfitz/iter"
 
 	"github.com/lovedboy/torrent/dht"
-	"github.com/lovedboy/torrent/dht/krpc"
 )
 
 func main() {
@@ -45,7 +45,7 @@ func receivePongs(pongChan chan pong, timeout <-chan time.Time, maxPongs int) (n
 				break
 			}
 			numResp++
-			fmt.Printf("%-65s %s\n", fmt.Sprintf("%x (%s):", pong.krpc.SenderID(), pong.addr), pong.rtt)
+			fmt.Printf("%-65s %s\n", fmt.Sprintf("%x (%s):", pong.id, pong.addr), pong.rtt)
 		case <-timeout:
 			fmt.Fprintf(os.Stderr, "timed out\n")
 			return
@@ -66,7 +66,7 @@ func startPings(s *dht.Server, pongChan chan pong, nodes []string) {
 
 type pong struct {
 	addr  string
-	krpc  krpc.Msg
+	id    string
 	msgOk bool
 	rtt   time.Duration
 }
@@ -76,19 +76,17 @@ func ping(netloc string, pongChan chan pong, s *dht.Server) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	t, err := s.Ping(addr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	start := time.Now()
-	t.SetResponseHandler(func(addr string) func(krpc.Msg, bool) {
-		return func(resp krpc.Msg, ok bool) {
-			pongChan <- pong{
-				addr:  addr,
-				krpc:  resp,
-				rtt:   time.Now().Sub(start),
-				msgOk: ok,
-			}
+	go func() {
+		start := time.Now()
+		r, err := s.Ping(context.Background(), addr)
+		p := pong{
+			addr:  netloc,
+			rtt:   time.Now().Sub(start),
+			msgOk: err == nil,
+		}
+		if r != nil {
+			p.id = r.ID
 		}
-	}(netloc))
+		pongChan <- p
+	}()
 }
@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"net"
+
 	"github.com/lovedboy/torrent/dht"
 	"github.com/lovedboy/torrent/iplist"
 	"github.com/lovedboy/torrent/storage"
@@ -20,7 +22,9 @@ type Config struct {
 	DisablePEX      bool `long:"disable-pex"`
 	// Don't create a DHT.
 	NoDHT bool `long:"disable-dht"`
-	// Overrides the default DHT configuration.
+	// Overrides the default DHT configuration. If DHTConfig.StateFile is set,
+	// the DHT routing table is saved there when the Client is closed, and
+	// restored from it when the next one starts.
 	DHTConfig dht.ServerConfig
 	// Don't ever send chunks to peers.
 	NoUpload bool `long:"no-upload"`
@@ -40,8 +44,22 @@ type Config struct {
 
 	IPBlocklist iplist.Ranger
 	DisableIPv6 bool `long:"disable-ipv6"`
-	// how many kB can be send every second
+	// Our IP as seen by peers. It's used to prioritize peers per BEP 40. If
+	// not set, it's learned from the "yourip" field in peers' extended
+	// handshakes, once several peers agree on it.
+	PublicIP net.IP
+	// The number of peers unchoked for each torrent, including the optimistic
+	// unchoke. Defaults to 4.
+	UploadSlots int `long:"upload-slots"`
+	// How many kB of piece data can be sent every second. Deprecated in
+	// favour of UploadRateLimit, which is used instead if it's set.
 	SendPieceRate int64 `long:"max-kbyte-can-send-every-second"`
+	// Limits the bytes per second of piece data sent to all peers. 0 is
+	// unlimited. It can be changed later with Client.SetUploadRateLimit.
+	UploadRateLimit int64 `long:"upload-rate-limit" description:"maximum bytes per second to upload"`
+	// Limits the bytes per second of piece data received from all peers. 0
+	// is unlimited. It can be changed later with Client.SetDownloadRateLimit.
+	DownloadRateLimit int64 `long:"download-rate-limit" description:"maximum bytes per second to download"`
 	// Perform logging and any other behaviour that will help debug.
 	Debug bool `help:"enable debug logging"`
 }
@@ -25,22 +25,43 @@ import (
 
 var optimizedCancels = expvar.NewInt("optimizedCancels")
 
-type peerSource byte
+// Describes how we learned of a peer.
+type PeerSource byte
 
 const (
-	peerSourceTracker  = '\x00' // It's the default.
-	peerSourceIncoming = 'I'
-	peerSourceDHT      = 'H'
-	peerSourcePEX      = 'X'
+	PeerSourceTracker  PeerSource = '\x00' // It's the default.
+	PeerSourceIncoming PeerSource = 'I'
+	PeerSourceDHT      PeerSource = 'H'
+	PeerSourcePEX      PeerSource = 'X'
+	PeerSourceWebSeed  PeerSource = 'W'
 )
 
+func (ps PeerSource) String() string {
+	switch ps {
+	case PeerSourceTracker:
+		return "tracker"
+	case PeerSourceIncoming:
+		return "incoming"
+	case PeerSourceDHT:
+		return "dht"
+	case PeerSourcePEX:
+		return "pex"
+	case PeerSourceWebSeed:
+		return "webseed"
+	default:
+		return fmt.Sprintf("unknown (%q)", byte(ps))
+	}
+}
+
 // Maintains the state of a connection with a peer.
 type connection struct {
-	t         *Torrent
-	conn      net.Conn
-	rw        io.ReadWriter // The real slim shady
+	t    *Torrent
+	conn net.Conn
+	rw   io.ReadWriter // The real slim shady
+	// Set if this is a web seed rather than a peer.
+	webSeed   *webSeed
 	encrypted bool
-	Discovery peerSource
+	Discovery PeerSource
 	uTP       bool
 	closed    missinggo.Event
 
@@ -50,6 +71,11 @@ type connection struct {
 	goodPiecesDirtied      int
 	badPiecesDirtied       int
 
+	stats ConnStats
+	// Recent payload rates.
+	downloadRate rollingRate
+	uploadRate   rollingRate
+
 	lastMessageReceived     time.Time
 	completedHandshake      time.Time
 	lastUsefulChunkReceived time.Time
@@ -86,6 +112,10 @@ type connection struct {
 	PeerMaxRequests  int // Maximum pending requests the peer allows.
 	PeerExtensionIDs map[string]byte
 	PeerClientName   string
+	// From the "p" field in the extended handshake.
+	PeerListenPort int
+
+	pex pexConnState
 
 	pieceInclination  []int
 	pieceRequestOrder prioritybitmap.PriorityBitmap
@@ -111,10 +141,24 @@ func (cl *Client) newConnection(nc net.Conn) (c *connection) {
 }
 
 func (cn *connection) remoteAddr() net.Addr {
+	if cn.webSeed != nil {
+		return webSeedAddr(cn.webSeed.url)
+	}
 	return cn.conn.RemoteAddr()
 }
 
+// The BEP 40 priority of the connection, given our own IP and listen port.
+// It's 0 if our IP isn't known, or isn't comparable with the peer's.
+func (cn *connection) peerPriority(ourIP net.IP, ourPort int) peerPriority {
+	addr := cn.remoteAddr()
+	prio, _ := bep40Priority(ourIP, ourPort, missinggo.AddrIP(addr), missinggo.AddrPort(addr))
+	return prio
+}
+
 func (cn *connection) localAddr() net.Addr {
+	if cn.conn == nil {
+		return nil
+	}
 	return cn.conn.LocalAddr()
 }
 
@@ -415,8 +459,9 @@ func (cn *connection) writer(keepAliveTimeout time.Duration, cl *Client) {
 			if err != nil {
 				panic(err)
 			}
-			if msg.Type == pp.Piece && cl.config.SendPieceRate > 0 {
-				cl.rate.Wait(int64(len(b)))
+			if !msg.Keepalive && msg.Type == pp.Piece {
+				// Only the payload counts against upload limits.
+				waitRateLimits(int64(len(msg.Piece)), &cl.uploadLimit, &cn.t.uploadLimit)
 			}
 			connectionWriterWrite.Add(1)
 			n, err := buf.Write(b)
@@ -428,6 +473,7 @@ func (cn *connection) writer(keepAliveTimeout time.Duration, cl *Client) {
 				panic("short write")
 			}
 			cn.mu().Lock()
+			cn.wroteMsg(&msg, n)
 		}
 		cn.outgoingUnbufferedMessagesNotEmpty.Clear()
 		cn.mu().Unlock()
@@ -643,3 +689,18 @@ func (c *connection) requestPendingMetadata() {
 		c.requestMetadataPiece(pending[i])
 	}
 }
+
+func (cn *connection) wroteMsg(msg *pp.Message, n int) {
+	cn.stats.wroteMsg(msg, n)
+	cn.t.stats.wroteMsg(msg, n)
+}
+
+func (cn *connection) readMsg(msg *pp.Message) {
+	cn.stats.readMsg(msg)
+	cn.t.stats.readMsg(msg)
+}
+
+func (cn *connection) readBytes(n int64) {
+	cn.stats.readBytes(n)
+	cn.t.stats.readBytes(n)
+}
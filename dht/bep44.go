@@ -0,0 +1,213 @@
+package dht
+
+// get and put queries, per http://www.bittorrent.org/beps/bep_0044.html.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"time"
+
+	"github.com/lovedboy/torrent/bencode"
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+var (
+	ErrItemNotFound = errors.New("item not found")
+	errNoPutTargets = errors.New("no nodes accepted the put")
+)
+
+func (s *Server) handleGet(source Addr, m krpc.Msg) {
+	args := m.A
+	if len(args.Target) != 20 {
+		s.badQuery(source, m.T, "bad target")
+		return
+	}
+	r := krpc.Return{
+		Token: s.tokens.create(source.UDPAddr().IP, time.Now()),
+	}
+	s.setReturnNodes(&r, source, args.Want, args.Target)
+	if i, ok := s.items.get(args.Target, time.Now()); ok {
+		if i.Mutable() {
+			seq := i.Seq
+			r.K = string(i.K[:])
+			r.Sig = string(i.Sig[:])
+			r.Seq = &seq
+		}
+		if !i.Mutable() || args.Seq == nil || i.Seq > *args.Seq {
+			r.V = i.V
+		}
+	}
+	s.reply(source, m.T, r)
+}
+
+func (s *Server) handlePut(source Addr, m krpc.Msg) {
+	args := m.A
+	now := time.Now()
+	if len(args.V) == 0 {
+		putBadQuery.Add(1)
+		s.badQuery(source, m.T, "missing v")
+		return
+	}
+	if !s.tokens.valid(args.Token, source.UDPAddr().IP, now) {
+		putBadQuery.Add(1)
+		s.replyBadToken(source, m.T)
+		return
+	}
+	if len(args.V) > maxItemValueLen {
+		s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeMessageTooBig, Msg: "message (v field) too big"})
+		return
+	}
+	i := Item{V: args.V}
+	if args.K != "" {
+		if len(args.Salt) > maxItemSaltLen {
+			s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeSaltTooBig, Msg: "salt (salt field) too big"})
+			return
+		}
+		if len(args.K) != 32 || len(args.Sig) != 64 || args.Seq == nil {
+			putBadQuery.Add(1)
+			s.badQuery(source, m.T, "bad k, sig or seq")
+			return
+		}
+		copy(i.K[:], args.K)
+		copy(i.Sig[:], args.Sig)
+		i.Salt = []byte(args.Salt)
+		i.Seq = *args.Seq
+		if !i.verify() {
+			s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeInvalidSignature, Msg: "invalid signature"})
+			return
+		}
+	}
+	target := i.Target()
+	if old, ok := s.items.get(string(target[:]), now); ok && i.Mutable() {
+		if args.Cas != nil && *args.Cas != old.Seq {
+			s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeCasMismatch, Msg: "CAS mismatch, re-read value and try again"})
+			return
+		}
+		if i.Seq < old.Seq || i.Seq == old.Seq && !bytes.Equal(i.V, old.V) {
+			s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeSeqTooLow, Msg: "sequence number less than current"})
+			return
+		}
+	}
+	if !s.items.put(string(target[:]), i, now) {
+		putItemStoreFull.Add(1)
+	}
+	s.reply(source, m.T, krpc.Return{})
+}
+
+// Returns the item in the response if it's valid for the target.
+func itemFromReturn(r *krpc.Return, target [20]byte, salt []byte) (i Item, ok bool) {
+	if len(r.V) == 0 {
+		return
+	}
+	i.V = r.V
+	if r.K == "" {
+		ok = sha1.Sum(i.V) == target
+		return
+	}
+	if len(r.K) != 32 || len(r.Sig) != 64 || r.Seq == nil {
+		return
+	}
+	copy(i.K[:], r.K)
+	copy(i.Sig[:], r.Sig)
+	i.Salt = salt
+	i.Seq = *r.Seq
+	ok = i.Target() == target && i.verify()
+	return
+}
+
+// Starts a traversal with get queries toward the target.
+func (s *Server) getTraversal(ctx context.Context, target [20]byte) *traversal {
+	return s.newTraversal(ctx, string(target[:]), func(ctx context.Context, addr Addr) (*krpc.Return, error) {
+		return s.queryLiftingNodes(ctx, addr, "get", map[string]interface{}{
+			"target": string(target[:]),
+			"want":   s.want(),
+		})
+	})
+}
+
+func (s *Server) getItem(ctx context.Context, target [20]byte, salt []byte) (ret Item, err error) {
+	found := false
+	t := s.getTraversal(ctx, target)
+	t.onResponse = func(_ traversalNode, r *krpc.Return) {
+		i, ok := itemFromReturn(r, target, salt)
+		if ok && (!found || i.Seq > ret.Seq) {
+			ret = i
+			found = true
+		}
+	}
+	t.run()
+	if !found {
+		err = ErrItemNotFound
+	}
+	return
+}
+
+// Looks up the immutable item with the target.
+func (s *Server) GetImmutable(ctx context.Context, target [20]byte) (Item, error) {
+	return s.getItem(ctx, target, nil)
+}
+
+// Looks up the mutable item with the public key and salt, returning the most
+// recent version found.
+func (s *Server) GetMutable(ctx context.Context, k [32]byte, salt []byte) (Item, error) {
+	return s.getItem(ctx, MutableItemTarget(k, salt), salt)
+}
+
+// Stores the item on the nodes closest to its target. It succeeds if any of
+// them accept it.
+func (s *Server) Put(ctx context.Context, i Item) error {
+	return s.put(ctx, i, nil)
+}
+
+// Like Put, but the nodes only accept a mutable item if the seq of the
+// version they have is cas.
+func (s *Server) PutCAS(ctx context.Context, i Item, cas int64) error {
+	return s.put(ctx, i, &cas)
+}
+
+func (s *Server) put(ctx context.Context, i Item, cas *int64) (err error) {
+	target := i.Target()
+	nodes := s.getTraversal(ctx, target).run()
+	args := map[string]interface{}{
+		"v": bencode.Bytes(i.V),
+	}
+	if i.Mutable() {
+		args["k"] = string(i.K[:])
+		args["sig"] = string(i.Sig[:])
+		args["seq"] = i.Seq
+		if len(i.Salt) != 0 {
+			args["salt"] = string(i.Salt)
+		}
+		if cas != nil {
+			args["cas"] = *cas
+		}
+	}
+	errs := make(chan error, len(nodes))
+	sent := 0
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		a := map[string]interface{}{"token": n.token}
+		for k, v := range args {
+			a[k] = v
+		}
+		go func(addr Addr) {
+			_, err := s.Query(ctx, addr, "put", a)
+			errs <- err
+		}(n.addr)
+		sent++
+	}
+	err = errNoPutTargets
+	for ; sent != 0; sent-- {
+		e := <-errs
+		if e == nil {
+			err = nil
+		} else if _, ok := e.(krpc.KRPCError); ok && err != nil {
+			err = e
+		}
+	}
+	return
+}
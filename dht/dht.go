@@ -14,11 +14,54 @@ import (
 )
 
 const (
-	maxNodes = 320
+	// The routing table's bucket size.
+	bucketSize = 8
+	// Nodes that have been heard from within this time are good.
+	nodeGoodDuration = 15 * time.Minute
+	// Nodes that fail to respond to this many queries in a row are bad.
+	maxNodeFailures = 2
+	// Buckets that don't change in this time are refreshed.
+	bucketRefreshInterval = 15 * time.Minute
+	// Limits on the peers stored from announce_peer.
+	maxStoredInfoHashes       = 1000
+	maxStoredPeersPerInfoHash = 100
+	storedPeerTTL             = 30 * time.Minute
+	// The most peers returned in a get_peers reply.
+	maxReturnedPeers    = 50
+	tokenRotateInterval = 5 * time.Minute
+	// Limits on BEP 44 items.
+	maxItemValueLen = 1000
+	maxItemSaltLen  = 64
+	maxStoredItems  = 1000
+	storedItemTTL   = 2 * time.Hour
+	// The most infohashes returned in a sample_infohashes reply, so that it
+	// fits in a packet, and how often the sample changes.
+	maxSampledInfoHashes     = 20
+	sampleInfoHashesInterval = 10 * time.Minute
+	// Queries answered per second from each IP and in total, and the bursts
+	// allowed above that. IPs that send queryFloodOverruns queries over their
+	// limit, before it's fully recovered, are ignored for
+	// queryFloodBlockDuration.
+	perIPQueryRate          = 5
+	perIPQueryBurst         = 25
+	globalQueryRate         = 500
+	globalQueryBurst        = 1000
+	queryFloodOverruns      = 25
+	queryFloodBlockDuration = 5 * time.Minute
+	// Bounds on the IPs tracked for rate limiting.
+	maxRateLimitedIPs = 10000
+	maxTempBlockedIPs = 10000
+	// Addresses are marked bad after this many protocol violations, unless
+	// they go this long without one.
+	maxProtocolViolations   = 5
+	protocolViolationMemory = 30 * time.Minute
+	maxReputations          = 10000
 )
 
-var (
-	queryResendEvery = 5 * time.Second
+// Used when ServerConfig doesn't set them.
+const (
+	defaultQueryResendDelay = 5 * time.Second
+	defaultQueryTries       = 3
 )
 
 var maxDistance big.Int
@@ -62,10 +105,20 @@ type ServerConfig struct {
 	// Initial IP blocklist to use. Applied before serving and bootstrapping
 	// begins.
 	IPBlocklist iplist.Ranger
-	// Used to secure the server's ID. Defaults to the Conn's LocalAddr().
+	// Used to secure the server's ID. Defaults to the Conn's LocalAddr(). If
+	// it's not set, the ID is changed to remain secure when a majority of
+	// other nodes report a different IP for us.
 	PublicIP net.IP
 
 	OnQuery func(*krpc.Msg, net.Addr) bool
+	// If set, the node ID and routing table are restored from this file when
+	// the server is created, and saved to it when it's closed. NodeIdHex
+	// takes precedence over the saved ID.
+	StateFile string
+	// How long to wait for a reply before resending a query, and how many
+	// times a query is sent before it times out. Default to 5s and 3.
+	QueryResendDelay time.Duration
+	QueryTries       int
 }
 
 // ServerStats instance is returned by Server.Stats() and stores Server metrics
@@ -81,6 +134,11 @@ type ServerStats struct {
 	ConfirmedAnnounces int
 	// Nodes that have been blocked.
 	BadNodes uint
+	// Infohashes and peers stored from announce_peer queries.
+	StoredInfoHashes int
+	StoredPeers      int
+	// Items stored from put queries.
+	StoredItems int
 }
 
 func makeSocket(addr string) (socket *net.UDPConn, err error) {
@@ -127,13 +185,43 @@ func (nid *nodeID) ByteString() string {
 }
 
 type node struct {
-	addr          Addr
-	id            nodeID
-	announceToken string
+	addr Addr
+	id   nodeID
 
 	lastGotQuery    time.Time
 	lastGotResponse time.Time
 	lastSentQuery   time.Time
+	// Queries that timed out since the last response.
+	failedQueries int
+}
+
+// Node states, per http://www.bittorrent.org/beps/bep_0005.html. Ordered from
+// most to least useful.
+type nodeState int
+
+const (
+	nodeGood nodeState = iota
+	nodeQuestionable
+	nodeBad
+)
+
+func (n *node) state(now time.Time) nodeState {
+	if n.failedQueries >= maxNodeFailures {
+		return nodeBad
+	}
+	if !n.lastGotResponse.IsZero() {
+		if now.Sub(n.lastGotResponse) < nodeGoodDuration || now.Sub(n.lastGotQuery) < nodeGoodDuration {
+			return nodeGood
+		}
+	}
+	return nodeQuestionable
+}
+
+func (n *node) lastSeen() time.Time {
+	if n.lastGotQuery.After(n.lastGotResponse) {
+		return n.lastGotQuery
+	}
+	return n.lastGotResponse
 }
 
 func (n *node) IsSecure() bool {
@@ -171,8 +259,12 @@ func (n *node) NodeInfo() (ret krpc.NodeInfo) {
 	return
 }
 
+func (n *node) ipv6() bool {
+	return n.addr.UDPAddr().IP.To4() == nil
+}
+
 func (n *node) DefinitelyGood() bool {
-	if len(n.idString()) != 20 {
+	if n.id.IsUnset() {
 		return false
 	}
 	// No reason to think ill of them if they've never been queried.
@@ -183,7 +275,7 @@ func (n *node) DefinitelyGood() bool {
 	if n.lastSentQuery.Before(n.lastGotResponse) {
 		return true
 	}
-	return true
+	return n.failedQueries < maxNodeFailures
 }
 
 func jitterDuration(average time.Duration, plusMinus time.Duration) time.Duration {
@@ -199,20 +291,24 @@ func (p *Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.FormatInt(int64(p.Port), 10))
 }
 
-func bootstrapAddrs(nodeAddrs []string) (addrs []*net.UDPAddr, err error) {
+// Resolves the bootstrap nodes for each of the given UDP networks.
+func bootstrapAddrs(networks []string, nodeAddrs []string) (addrs []*net.UDPAddr, err error) {
 	bootstrapNodes := nodeAddrs
 	if len(bootstrapNodes) == 0 {
 		bootstrapNodes = []string{
 			"router.utorrent.com:6881",
 			"router.bittorrent.com:6881",
+			"dht.transmissionbt.com:6881",
 		}
 	}
-	for _, addrStr := range bootstrapNodes {
-		udpAddr, err := net.ResolveUDPAddr("udp4", addrStr)
-		if err != nil {
-			continue
+	for _, network := range networks {
+		for _, addrStr := range bootstrapNodes {
+			udpAddr, err := net.ResolveUDPAddr(network, addrStr)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, udpAddr)
 		}
-		addrs = append(addrs, udpAddr)
 	}
 	if len(addrs) == 0 {
 		err = errors.New("nothing resolved")
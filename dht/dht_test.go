@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"context"
 	"encoding/hex"
 	"log"
 	"math/big"
@@ -124,19 +125,43 @@ func TestPing(t *testing.T) {
 	})
 	require.NoError(t, err)
 	defer srv0.Close()
-	tn, err := srv.Ping(&net.UDPAddr{
+	r, err := srv.Ping(context.Background(), &net.UDPAddr{
 		IP:   []byte{127, 0, 0, 1},
 		Port: srv0.Addr().(*net.UDPAddr).Port,
 	})
 	require.NoError(t, err)
-	defer tn.Close()
-	ok := make(chan bool)
-	tn.SetResponseHandler(func(msg krpc.Msg, msgOk bool) {
-		ok <- msg.SenderID() == srv0.ID()
+	assert.Equal(t, srv0.ID(), r.ID)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+		QueryResendDelay:   10 * time.Millisecond,
+		QueryTries:         2,
 	})
-	if !<-ok {
-		t.FailNow()
+	require.NoError(t, err)
+	defer srv.Close()
+	// Nothing replies from here.
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer sink.Close()
+	addr := sink.LocalAddr().(*net.UDPAddr)
+	_, err = srv.Ping(context.Background(), addr)
+	assert.Equal(t, ErrQueryTimedOut, err)
+	assert.Equal(t, 0, srv.NumInFlightQueries(addr))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := srv.Ping(ctx, addr)
+		done <- err
+	}()
+	for srv.NumInFlightQueries(addr) == 0 {
+		time.Sleep(time.Millisecond)
 	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, 0, srv.NumInFlightQueries(addr))
 }
 
 func TestServerCustomNodeId(t *testing.T) {
@@ -198,16 +223,10 @@ func TestHook(t *testing.T) {
 	defer srv0.Close()
 	// Ping srv0 from srv to trigger hook. Should also receive a response.
 	t.Log("TestHook: Servers created, hook for ping established. Calling Ping.")
-	tn, err := srv.Ping(&net.UDPAddr{
+	go srv.Ping(context.Background(), &net.UDPAddr{
 		IP:   []byte{127, 0, 0, 1},
 		Port: srv0.Addr().(*net.UDPAddr).Port,
 	})
-	assert.NoError(t, err)
-	defer tn.Close()
-	// Await response from hooked server
-	tn.SetResponseHandler(func(msg krpc.Msg, b bool) {
-		t.Log("TestHook: Sender received response from pinged hook server, so normal execution resumed.")
-	})
 	// Await signal that hook has been called.
 	select {
 	case <-hookCalled:
@@ -231,3 +250,32 @@ func TestResolveBadAddr(t *testing.T) {
 	require.NoError(t, err)
 	assert.False(t, validNodeAddr(NewAddr(ua)))
 }
+
+func TestCanReach(t *testing.T) {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	assert.True(t, s.CanReach(net.ParseIP("1.2.3.4")))
+	assert.False(t, s.CanReach(net.ParseIP("2001:db8::1")))
+	assert.EqualValues(t, []string{krpc.WantNodes}, s.want())
+}
+
+func TestWantNodes(t *testing.T) {
+	src4 := NewAddr(&net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1})
+	src6 := NewAddr(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1})
+	n4, n6 := wantNodes(src4, nil)
+	assert.True(t, n4)
+	assert.False(t, n6)
+	n4, n6 = wantNodes(src6, nil)
+	assert.False(t, n4)
+	assert.True(t, n6)
+	n4, n6 = wantNodes(src4, []string{krpc.WantNodes6})
+	assert.False(t, n4)
+	assert.True(t, n6)
+	n4, n6 = wantNodes(src6, []string{krpc.WantNodes, krpc.WantNodes6})
+	assert.True(t, n4)
+	assert.True(t, n6)
+}
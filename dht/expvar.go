@@ -11,4 +11,19 @@ var (
 	readUnmarshalError = expvar.NewInt("dhtReadUnmarshalError")
 	readQuery          = expvar.NewInt("dhtReadQuery")
 	announceErrors     = expvar.NewInt("dhtAnnounceErrors")
+	// Queries dropped for exceeding the source's rate limit, and the global
+	// one.
+	readQueryFlood      = expvar.NewInt("dhtReadQueryFlood")
+	readQueryOverBudget = expvar.NewInt("dhtReadQueryOverBudget")
+	// Received announce_peer queries that were dropped.
+	announceBadQuery      = expvar.NewInt("dhtAnnounceBadQuery")
+	announcePeerStoreFull = expvar.NewInt("dhtAnnouncePeerStoreFull")
+	// Received put queries that were dropped.
+	putBadQuery      = expvar.NewInt("dhtPutBadQuery")
+	putItemStoreFull = expvar.NewInt("dhtPutItemStoreFull")
+	// Malformed queries and replies received.
+	protocolViolations = expvar.NewInt("dhtProtocolViolations")
+	// Times the node ID changed to follow the external IP voted by other
+	// nodes.
+	nodeIDRotations = expvar.NewInt("dhtNodeIDRotations")
 )
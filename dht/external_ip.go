@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// Counts the IP reported by a node that replied to us. If the vote changes
+// our external IP, the ID is changed to remain secure for it.
+func (s *Server) voteExternalIP(voter Addr, ip net.IP) {
+	voterIP := voter.UDPAddr().IP
+	if len(ip) == 0 || (ip.To4() == nil) != (voterIP.To4() == nil) {
+		// Our address in another family says nothing about this socket.
+		return
+	}
+	now := time.Now()
+	s.ipVotes.Vote(voterIP, ip, now)
+	w := s.ipVotes.Winner(s.externalIP, now)
+	if w == nil || w.Equal(s.externalIP) {
+		return
+	}
+	s.externalIP = w
+	if s.config.NoSecurity || s.config.NodeIdHex != "" || s.config.PublicIP != nil {
+		// The ID was chosen by the user, or for a known IP.
+		return
+	}
+	s.setSecureID(w)
+}
+
+// Changes the ID to be secure for the IP, and rebuilds the table around it.
+func (s *Server) setSecureID(ip net.IP) {
+	id := []byte(s.id)
+	SecureNodeId(id, ip)
+	if string(id) == s.id {
+		return
+	}
+	nodeIDRotations.Add(1)
+	now := time.Now()
+	nodes := s.table.nodes()
+	s.id = string(id)
+	s.table = newTable(nodeIDFromString(s.id), bucketSize)
+	for _, n := range nodes {
+		s.table.add(n, now)
+	}
+}
+
+// Returns our IP as reported by a majority of other nodes, or the configured
+// PublicIP. It's nil if neither is known.
+func (s *Server) PublicIP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.externalIP != nil {
+		return s.externalIP
+	}
+	return s.config.PublicIP
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/internal/ipvote"
+)
+
+func TestServerSecuresIDForVotedIP(t *testing.T) {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	ip := net.IPv4(93, 184, 216, 34)
+	assert.False(t, NodeIdSecure(s.ID(), ip))
+	assert.Nil(t, s.PublicIP())
+	s.mu.Lock()
+	for i := 0; i < ipvote.MinVotes; i++ {
+		voter := NewAddr(&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 1234})
+		// Votes from another address family don't count.
+		s.voteExternalIP(voter, net.ParseIP("2001:db8::1"))
+		s.voteExternalIP(voter, ip)
+	}
+	s.mu.Unlock()
+	assert.True(t, ip.Equal(s.PublicIP()))
+	assert.True(t, NodeIdSecure(s.ID(), ip))
+}
+
+// ID can be read while votes change it. This is for the race detector.
+func TestIDWhileVoting(t *testing.T) {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.ID()
+		}
+	}()
+	for i := 0; i < ipvote.MinVotes; i++ {
+		s.mu.Lock()
+		voter := NewAddr(&net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 1234})
+		s.voteExternalIP(voter, net.IPv4(93, 184, 216, 34))
+		s.mu.Unlock()
+	}
+	<-done
+}
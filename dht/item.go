@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+// An item stored in the DHT, per http://www.bittorrent.org/beps/bep_0044.html.
+// Immutable items are stored under the hash of their value. Mutable items are
+// stored under the hash of their public key and salt, and can be updated by
+// the holder of the private key.
+type Item struct {
+	// The bencoded value.
+	V []byte
+	// The ed25519 public key of a mutable item. The remaining fields are only
+	// used by mutable items.
+	K    [32]byte
+	Salt []byte
+	Seq  int64
+	Sig  [64]byte
+}
+
+var (
+	errItemTooBig = errors.New("item value too big")
+	errSaltTooBig = errors.New("item salt too big")
+)
+
+// Returns an immutable item for the value, which is bencoded.
+func NewImmutableItem(v interface{}) (ret Item, err error) {
+	ret.V, err = bencode.Marshal(v)
+	if err == nil && len(ret.V) > maxItemValueLen {
+		err = errItemTooBig
+	}
+	return
+}
+
+// Returns a mutable item for the value, which is bencoded, signed with the
+// key. Later versions should have a higher seq.
+func NewMutableItem(key ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (ret Item, err error) {
+	if len(salt) > maxItemSaltLen {
+		err = errSaltTooBig
+		return
+	}
+	ret, err = NewImmutableItem(v)
+	if err != nil {
+		return
+	}
+	copy(ret.K[:], key.Public().(ed25519.PublicKey))
+	ret.Salt = salt
+	ret.Seq = seq
+	copy(ret.Sig[:], ed25519.Sign(key, itemSignBuffer(salt, seq, ret.V)))
+	return
+}
+
+func (i *Item) Mutable() bool {
+	return i.K != [32]byte{}
+}
+
+// The key the item is stored under.
+func (i *Item) Target() [20]byte {
+	if i.Mutable() {
+		return MutableItemTarget(i.K, i.Salt)
+	}
+	return sha1.Sum(i.V)
+}
+
+// Returns the target of mutable items with the public key and salt.
+func MutableItemTarget(k [32]byte, salt []byte) [20]byte {
+	return sha1.Sum(append(k[:], salt...))
+}
+
+// Checks the signature of a mutable item.
+func (i *Item) verify() bool {
+	return ed25519.Verify(i.K[:], itemSignBuffer(i.Salt, i.Seq, i.V), i.Sig[:])
+}
+
+// The data that's signed for a mutable item.
+func itemSignBuffer(salt []byte, seq int64, v []byte) []byte {
+	var buf bytes.Buffer
+	if len(salt) != 0 {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(v)
+	return buf.Bytes()
+}
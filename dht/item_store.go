@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"time"
+)
+
+// Stores the items put to us, to return in get replies. It's bounded, and
+// items expire if they aren't put again.
+type itemStore struct {
+	items map[string]storedItem // Keyed by target.
+}
+
+type storedItem struct {
+	Item
+	expires time.Time
+}
+
+func (is *itemStore) get(target string, now time.Time) (Item, bool) {
+	si, ok := is.items[target]
+	if ok && !now.Before(si.expires) {
+		delete(is.items, target)
+		ok = false
+	}
+	return si.Item, ok
+}
+
+// Adds or replaces the item. Returns false if there's no room for it.
+func (is *itemStore) put(target string, i Item, now time.Time) bool {
+	if is.items == nil {
+		is.items = make(map[string]storedItem)
+	}
+	if _, ok := is.items[target]; !ok && len(is.items) >= maxStoredItems {
+		is.expire(now)
+		if len(is.items) >= maxStoredItems {
+			return false
+		}
+	}
+	is.items[target] = storedItem{i, now.Add(storedItemTTL)}
+	return true
+}
+
+func (is *itemStore) expire(now time.Time) {
+	for target, si := range is.items {
+		if !now.Before(si.expires) {
+			delete(is.items, target)
+		}
+	}
+}
+
+func (is *itemStore) len() int {
+	return len(is.items)
+}
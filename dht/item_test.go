@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Test vectors from http://www.bittorrent.org/beps/bep_0044.html.
+func TestItemTestVectors(t *testing.T) {
+	i, err := NewImmutableItem("Hello World!")
+	require.NoError(t, err)
+	assert.Equal(t, "e5f96f6f38320f0f33959cb4d3d656452117aadb", targetHex(i))
+
+	i = Item{
+		V:   []byte("12:Hello World!"),
+		Seq: 1,
+	}
+	copy(i.K[:], mustDecodeHex("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+	copy(i.Sig[:], mustDecodeHex("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01"))
+	assert.True(t, i.verify())
+	assert.Equal(t, "4a533d47ec9c7d95b1ad75f576cffc641853b750", targetHex(i))
+
+	i.Salt = []byte("foobar")
+	assert.False(t, i.verify())
+	copy(i.Sig[:], mustDecodeHex("6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08"))
+	assert.True(t, i.verify())
+	assert.Equal(t, "411eba73b6f087ca51a3795d9c8c938d365e32c1", targetHex(i))
+	assert.Equal(t, "4:salt6:foobar3:seqi1e1:v12:Hello World!", string(itemSignBuffer(i.Salt, i.Seq, i.V)))
+}
+
+func targetHex(i Item) string {
+	t := i.Target()
+	return hex.EncodeToString(t[:])
+}
+
+func TestNewMutableItem(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	i, err := NewMutableItem(key, []byte("salt"), 3, map[string]int{"a": 1})
+	require.NoError(t, err)
+	assert.True(t, i.Mutable())
+	assert.True(t, i.verify())
+	assert.Equal(t, "d1:ai1ee", string(i.V))
+	i.Seq++
+	assert.False(t, i.verify())
+	_, err = NewMutableItem(key, make([]byte, maxItemSaltLen+1), 1, "")
+	assert.Error(t, err)
+	_, err = NewImmutableItem(make([]byte, maxItemValueLen))
+	assert.Error(t, err)
+}
+
+func TestPutGetItems(t *testing.T) {
+	srv0, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv0.Close()
+	srv1, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv1.Close()
+	ni := krpc.NodeInfo{Addr: srv0.Addr().(*net.UDPAddr)}
+	copy(ni.ID[:], srv0.ID())
+	srv1.AddNode(ni)
+
+	imm, err := NewImmutableItem("hello")
+	require.NoError(t, err)
+	require.NoError(t, srv1.Put(context.Background(), imm))
+	got, err := srv1.GetImmutable(context.Background(), imm.Target())
+	require.NoError(t, err)
+	assert.Equal(t, imm.V, got.V)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var k [32]byte
+	copy(k[:], pub)
+	_, err = srv1.GetMutable(context.Background(), k, nil)
+	assert.Equal(t, ErrItemNotFound, err)
+	m1, err := NewMutableItem(key, nil, 1, "v1")
+	require.NoError(t, err)
+	require.NoError(t, srv1.Put(context.Background(), m1))
+	m2, err := NewMutableItem(key, nil, 2, "v2")
+	require.NoError(t, err)
+	// The stored seq is 1.
+	assert.EqualValues(t, krpc.KRPCError{Code: krpc.ErrorCodeCasMismatch, Msg: "CAS mismatch, re-read value and try again"}, srv1.PutCAS(context.Background(), m2, 2))
+	require.NoError(t, srv1.PutCAS(context.Background(), m2, 1))
+	assert.EqualValues(t, krpc.ErrorCodeSeqTooLow, srv1.Put(context.Background(), m1).(krpc.KRPCError).Code)
+	got, err = srv1.GetMutable(context.Background(), k, nil)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, got.Seq)
+	assert.Equal(t, "2:v2", string(got.V))
+	assert.Equal(t, 2, srv0.Stats().StoredItems)
+}
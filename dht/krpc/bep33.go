@@ -0,0 +1,78 @@
+package krpc
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"net"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+const (
+	scrapeBloomFilterBits   = 2048
+	scrapeBloomFilterHashes = 2
+)
+
+// A bloom filter of peer IPs, as in the "BFsd" and "BFpe" of get_peers
+// responses to scrapes, per http://www.bittorrent.org/beps/bep_0033.html.
+type ScrapeBloomFilter [scrapeBloomFilterBits / 8]byte
+
+var (
+	_ bencode.Marshaler   = ScrapeBloomFilter{}
+	_ bencode.Unmarshaler = &ScrapeBloomFilter{}
+)
+
+func (me *ScrapeBloomFilter) AddIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.Sum(ip)
+	for i := 0; i < scrapeBloomFilterHashes; i++ {
+		index := (int(h[2*i]) | int(h[2*i+1])<<8) % scrapeBloomFilterBits
+		me[index/8] |= 1 << uint(index%8)
+	}
+}
+
+// Adds the IPs in other to the filter.
+func (me *ScrapeBloomFilter) Merge(other ScrapeBloomFilter) {
+	for i, b := range other {
+		me[i] |= b
+	}
+}
+
+// Estimates the number of distinct IPs added to the filter.
+func (me *ScrapeBloomFilter) EstimateCount() float64 {
+	zeroes := 0
+	for _, b := range me {
+		for i := uint(0); i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zeroes++
+			}
+		}
+	}
+	if zeroes == 0 {
+		// The filter is saturated. This is the most it can tell us.
+		zeroes = 1
+	}
+	m := float64(scrapeBloomFilterBits)
+	return math.Log(float64(zeroes)/m) / (scrapeBloomFilterHashes * math.Log(1-1/m))
+}
+
+func (me ScrapeBloomFilter) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal(me[:])
+}
+
+func (me *ScrapeBloomFilter) UnmarshalBencode(_b []byte) (err error) {
+	var b []byte
+	err = bencode.Unmarshal(_b, &b)
+	if err != nil {
+		return
+	}
+	if len(b) != len(me) {
+		err = fmt.Errorf("bad length: %d", len(b))
+		return
+	}
+	copy(me[:], b)
+	return
+}
@@ -0,0 +1,50 @@
+package krpc
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+// The test vector from http://www.bittorrent.org/beps/bep_0033.html.
+func TestScrapeBloomFilterEstimate(t *testing.T) {
+	var bf ScrapeBloomFilter
+	for i := 0; i < 256; i++ {
+		bf.AddIP(net.IPv4(192, 0, 2, byte(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.ParseIP("2001:db8::")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		bf.AddIP(ip)
+	}
+	assert.Equal(t, "f6c3f5ea", hex.EncodeToString(bf[:4]))
+	assert.InDelta(t, 1224.9308, bf.EstimateCount(), 0.0001)
+}
+
+func TestScrapeBloomFilterMerge(t *testing.T) {
+	var a, b ScrapeBloomFilter
+	assert.EqualValues(t, 0, a.EstimateCount())
+	a.AddIP(net.IPv4(1, 2, 3, 4))
+	b.AddIP(net.IPv4(1, 2, 3, 4))
+	b.AddIP(net.IPv4(5, 6, 7, 8))
+	a.Merge(b)
+	assert.Equal(t, b, a)
+	assert.InDelta(t, 2, a.EstimateCount(), 0.01)
+}
+
+func TestMarshalScrapeBloomFilter(t *testing.T) {
+	var bf ScrapeBloomFilter
+	bf.AddIP(net.IPv4(1, 2, 3, 4))
+	b, err := bencode.Marshal(bf)
+	require.NoError(t, err)
+	assert.Len(t, b, 4+256)
+	var bf1 ScrapeBloomFilter
+	require.NoError(t, bencode.Unmarshal(b, &bf1))
+	assert.Equal(t, bf, bf1)
+	assert.Error(t, bencode.Unmarshal([]byte("1:x"), &bf1))
+}
@@ -0,0 +1,39 @@
+package krpc
+
+import (
+	"fmt"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+// Infohashes concatenated into a single string, as in the "samples" of
+// sample_infohashes responses.
+type CompactInfohashes [][20]byte
+
+var _ bencode.Unmarshaler = &CompactInfohashes{}
+
+func (me *CompactInfohashes) UnmarshalBencode(_b []byte) (err error) {
+	var b []byte
+	err = bencode.Unmarshal(_b, &b)
+	if err != nil {
+		return
+	}
+	if len(b)%20 != 0 {
+		err = fmt.Errorf("bad length: %d", len(b))
+		return
+	}
+	for i := 0; i < len(b); i += 20 {
+		var ih [20]byte
+		copy(ih[:], b[i:])
+		*me = append(*me, ih)
+	}
+	return
+}
+
+func (me CompactInfohashes) MarshalBencode() ([]byte, error) {
+	b := make([]byte, 0, 20*len(me))
+	for _, ih := range me {
+		b = append(b, ih[:]...)
+	}
+	return bencode.Marshal(b)
+}
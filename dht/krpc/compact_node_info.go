@@ -1,8 +1,6 @@
 package krpc
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 
@@ -14,36 +12,59 @@ type CompactIPv4NodeInfo []NodeInfo
 var _ bencode.Unmarshaler = &CompactIPv4NodeInfo{}
 
 func (i *CompactIPv4NodeInfo) UnmarshalBencode(_b []byte) (err error) {
+	return unmarshalCompactNodeInfo(_b, (*[]NodeInfo)(i), CompactIPv4NodeInfoLen, (*NodeInfo).UnmarshalCompactIPv4)
+}
+
+func (i CompactIPv4NodeInfo) MarshalBencode() (ret []byte, err error) {
+	return marshalCompactNodeInfo(i, CompactIPv4NodeInfoLen, (*NodeInfo).PutCompact)
+}
+
+// The "nodes6" value in responses, per
+// http://www.bittorrent.org/beps/bep_0032.html.
+type CompactIPv6NodeInfo []NodeInfo
+
+var _ bencode.Unmarshaler = &CompactIPv6NodeInfo{}
+
+func (i *CompactIPv6NodeInfo) UnmarshalBencode(_b []byte) (err error) {
+	return unmarshalCompactNodeInfo(_b, (*[]NodeInfo)(i), CompactIPv6NodeInfoLen, (*NodeInfo).UnmarshalCompactIPv6)
+}
+
+func (i CompactIPv6NodeInfo) MarshalBencode() (ret []byte, err error) {
+	return marshalCompactNodeInfo(i, CompactIPv6NodeInfoLen, (*NodeInfo).PutCompactIPv6)
+}
+
+func unmarshalCompactNodeInfo(_b []byte, nis *[]NodeInfo, size int, unmarshal func(*NodeInfo, []byte) error) (err error) {
 	var b []byte
 	err = bencode.Unmarshal(_b, &b)
 	if err != nil {
 		return
 	}
-	if len(b)%CompactIPv4NodeInfoLen != 0 {
+	if len(b)%size != 0 {
 		err = fmt.Errorf("bad length: %d", len(b))
 		return
 	}
-	for k := 0; k < len(b); k += CompactIPv4NodeInfoLen {
+	for k := 0; k < len(b); k += size {
 		var ni NodeInfo
-		err = ni.UnmarshalCompactIPv4(b[k : k+CompactIPv4NodeInfoLen])
+		err = unmarshal(&ni, b[k:k+size])
 		if err != nil {
 			return
 		}
-		*i = append(*i, ni)
+		*nis = append(*nis, ni)
 	}
 	return
 }
 
-func (i CompactIPv4NodeInfo) MarshalBencode() (ret []byte, err error) {
-	var buf bytes.Buffer
-	for _, ni := range i {
-		buf.Write(ni.ID[:])
-		if ni.Addr == nil {
+func marshalCompactNodeInfo(nis []NodeInfo, size int, put func(*NodeInfo, []byte) error) (ret []byte, err error) {
+	b := make([]byte, len(nis)*size)
+	for i := range nis {
+		if nis[i].Addr == nil {
 			err = errors.New("nil addr in node info")
 			return
 		}
-		buf.Write(ni.Addr.IP.To4())
-		binary.Write(&buf, binary.BigEndian, uint16(ni.Addr.Port))
+		err = put(&nis[i], b[i*size:(i+1)*size])
+		if err != nil {
+			return
+		}
 	}
-	return bencode.Marshal(buf.Bytes())
+	return bencode.Marshal(b)
 }
@@ -6,6 +6,23 @@ import (
 	"github.com/lovedboy/torrent/bencode"
 )
 
+// Error codes from http://www.bittorrent.org/beps/bep_0005.html.
+const (
+	ErrorCodeGenericError  = 201
+	ErrorCodeServerError   = 202
+	ErrorCodeProtocolError = 203 // Such as a malformed packet, invalid arguments, or bad token
+	ErrorCodeMethodUnknown = 204
+)
+
+// Error codes from http://www.bittorrent.org/beps/bep_0044.html.
+const (
+	ErrorCodeMessageTooBig    = 205
+	ErrorCodeInvalidSignature = 206
+	ErrorCodeSaltTooBig       = 207
+	ErrorCodeCasMismatch      = 301
+	ErrorCodeSeqTooLow        = 302
+)
+
 // Represented as a string or list in bencode.
 type KRPCError struct {
 	Code int
@@ -3,6 +3,7 @@ package krpc
 import (
 	"fmt"
 
+	"github.com/lovedboy/torrent/bencode"
 	"github.com/lovedboy/torrent/util"
 )
 
@@ -32,13 +33,65 @@ type MsgArgs struct {
 	ID       string `bencode:"id"`        // ID of the quirying Node
 	InfoHash string `bencode:"info_hash"` // InfoHash of the torrent
 	Target   string `bencode:"target"`    // ID of the node sought
+	// The address families of nodes wanted in the response, "n4" and/or "n6".
+	// http://www.bittorrent.org/beps/bep_0032.html
+	Want []string `bencode:"want,omitempty"`
+	// get_peers arguments, per http://www.bittorrent.org/beps/bep_0033.html.
+	// Scrape asks for bloom filters of the swarm, and NoSeed leaves seeds out
+	// of the values.
+	Scrape bool `bencode:"scrape,omitempty"`
+	NoSeed bool `bencode:"noseed,omitempty"`
+	// announce_peer arguments. If ImpliedPort is set, Port is ignored and the
+	// source port of the query is used. Seed is set by seeders, per BEP 33.
+	Token       string `bencode:"token,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort bool   `bencode:"implied_port,omitempty"`
+	Seed        bool   `bencode:"seed,omitempty"`
+	// get and put arguments, per http://www.bittorrent.org/beps/bep_0044.html.
+	// In get, Seq asks for the value only if the stored item is newer.
+	V    bencode.Bytes `bencode:"v,omitempty"`
+	K    string        `bencode:"k,omitempty"`    // ed25519 public key
+	Salt string        `bencode:"salt,omitempty"` // Up to 64 bytes
+	Seq  *int64        `bencode:"seq,omitempty"`
+	Cas  *int64        `bencode:"cas,omitempty"`
+	Sig  string        `bencode:"sig,omitempty"` // ed25519 signature
 }
 
+// Values for MsgArgs.Want.
+const (
+	WantNodes  = "n4"
+	WantNodes6 = "n6"
+)
+
 type Return struct {
 	ID     string              `bencode:"id"` // ID of the querying node
 	Nodes  CompactIPv4NodeInfo `bencode:"nodes,omitempty"`
+	Nodes6 CompactIPv6NodeInfo `bencode:"nodes6,omitempty"`
 	Token  string              `bencode:"token,omitempty"`
-	Values []util.CompactPeer  `bencode:"values,omitempty"`
+	Values []util.CompactPeer  `bencode:"values,omitempty"` // IPv4 or IPv6 compact peers
+	// get responses, per http://www.bittorrent.org/beps/bep_0044.html.
+	V   bencode.Bytes `bencode:"v,omitempty"`
+	K   string        `bencode:"k,omitempty"`
+	Sig string        `bencode:"sig,omitempty"`
+	Seq *int64        `bencode:"seq,omitempty"`
+	// sample_infohashes responses, per
+	// http://www.bittorrent.org/beps/bep_0051.html. Interval is the seconds
+	// before the samples are worth requesting again, and Num is the number
+	// of infohashes the node has stored.
+	Interval int               `bencode:"interval,omitempty"`
+	Num      int               `bencode:"num,omitempty"`
+	Samples  CompactInfohashes `bencode:"samples,omitempty"`
+	// get_peers responses to scrapes, per
+	// http://www.bittorrent.org/beps/bep_0033.html. Bloom filters of the IPs
+	// of seeds and peers in the swarm.
+	BFsd *ScrapeBloomFilter `bencode:"BFsd,omitempty"`
+	BFpe *ScrapeBloomFilter `bencode:"BFpe,omitempty"`
+}
+
+// Returns the nodes in the response from both address families.
+func (r *Return) AllNodes() (ret []NodeInfo) {
+	ret = append(ret, r.Nodes...)
+	return append(ret, r.Nodes6...)
 }
 
 var _ fmt.Stringer = Msg{}
@@ -2,6 +2,7 @@ package krpc
 
 import (
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,6 +55,30 @@ func TestMarshalUnmarshalMsg(t *testing.T) {
 			},
 		},
 	}, "d1:rd2:id0:5:nodes26:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x02\x03\x04\x124e1:t2:\x8c%1:y1:re")
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "r",
+		T: "\x8c%",
+		R: &Return{
+			Nodes6: CompactIPv6NodeInfo{
+				NodeInfo{
+					Addr: &net.UDPAddr{
+						IP:   net.ParseIP("2001:db8::1"),
+						Port: 0x1234,
+					},
+				},
+			},
+		},
+	}, "d1:rd2:id0:6:nodes638:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x124e1:t2:\x8c%1:y1:re")
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "q",
+		Q: "find_node",
+		T: "a",
+		A: &MsgArgs{
+			ID:     "x",
+			Target: "y",
+			Want:   []string{WantNodes, WantNodes6},
+		},
+	}, "d1:ad2:id1:x9:info_hash0:6:target1:y4:wantl2:n42:n6ee1:q9:find_node1:t1:a1:y1:qe")
 	testMarshalUnmarshalMsg(t, Msg{
 		Y: "r",
 		T: "\x8c%",
@@ -66,6 +91,18 @@ func TestMarshalUnmarshalMsg(t *testing.T) {
 			},
 		},
 	}, "d1:rd2:id0:6:valuesl6:\x01\x02\x03\x04\x56\x78ee1:t2:\x8c%1:y1:re")
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "r",
+		T: "\x8c%",
+		R: &Return{
+			Interval: 600,
+			Num:      2,
+			Samples: CompactInfohashes{
+				{0: 1},
+				{19: 2},
+			},
+		},
+	}, "d1:rd2:id0:8:intervali600e3:numi2e7:samples40:\x01"+strings.Repeat("\x00", 38)+"\x02e1:t2:\x8c%1:y1:re")
 	testMarshalUnmarshalMsg(t, Msg{
 		Y: "r",
 		T: "\x03",
@@ -8,8 +8,11 @@ import (
 	"github.com/anacrolix/missinggo"
 )
 
-// The size in bytes of a NodeInfo in its compact binary representation.
-const CompactIPv4NodeInfoLen = 26
+// The sizes in bytes of a NodeInfo in its compact binary representations.
+const (
+	CompactIPv4NodeInfoLen = 26
+	CompactIPv6NodeInfoLen = 38
+)
 
 type NodeInfo struct {
 	ID   [20]byte
@@ -33,6 +36,22 @@ func (ni *NodeInfo) PutCompact(b []byte) error {
 	return nil
 }
 
+// Writes the node info to its compact IPv6 binary representation in b, per
+// http://www.bittorrent.org/beps/bep_0032.html. See CompactIPv6NodeInfoLen.
+func (ni *NodeInfo) PutCompactIPv6(b []byte) error {
+	if n := copy(b[:], ni.ID[:]); n != 20 {
+		panic(n)
+	}
+	if ni.Addr.IP.To4() != nil || len(ni.Addr.IP) != 16 {
+		return errors.New("expected ipv6 address")
+	}
+	if n := copy(b[20:], ni.Addr.IP); n != 16 {
+		panic(n)
+	}
+	binary.BigEndian.PutUint16(b[36:], uint16(ni.Addr.Port))
+	return nil
+}
+
 func (ni *NodeInfo) UnmarshalCompactIPv4(b []byte) error {
 	if len(b) != CompactIPv4NodeInfoLen {
 		return errors.New("expected 26 bytes")
@@ -44,3 +63,15 @@ func (ni *NodeInfo) UnmarshalCompactIPv4(b []byte) error {
 	}
 	return nil
 }
+
+func (ni *NodeInfo) UnmarshalCompactIPv6(b []byte) error {
+	if len(b) != CompactIPv6NodeInfoLen {
+		return errors.New("expected 38 bytes")
+	}
+	missinggo.CopyExact(ni.ID[:], b[:20])
+	ni.Addr = &net.UDPAddr{
+		IP:   append(make([]byte, 0, 16), b[20:36]...),
+		Port: int(binary.BigEndian.Uint16(b[36:38])),
+	}
+	return nil
+}
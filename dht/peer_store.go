@@ -0,0 +1,191 @@
+package dht
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+	"github.com/lovedboy/torrent/util"
+)
+
+// Stores the peers announced to us, to return in get_peers replies. It's
+// bounded in the number of infohashes and the peers for each, and peers expire
+// if they don't announce again.
+type peerStore struct {
+	infoHashes map[string]*storedInfoHash
+	// The infohashes returned in sample_infohashes replies, which are only
+	// refreshed every sampleInfoHashesInterval.
+	samples          krpc.CompactInfohashes
+	samplesRefreshed time.Time
+}
+
+type storedInfoHash struct {
+	peers map[string]storedPeer // Keyed by peer address.
+	// Bloom filters of the IPs that announced, for scrapes per
+	// http://www.bittorrent.org/beps/bep_0033.html. Unlike peers they aren't
+	// bounded in size. The filters are retired every storedPeerTTL, and
+	// scrapes get them merged with the previous ones.
+	filters, prevFilters scrapeFilters
+	filtersStarted       time.Time
+}
+
+type scrapeFilters struct {
+	seeds, peers krpc.ScrapeBloomFilter
+}
+
+func (sih *storedInfoHash) rotateFilters(now time.Time) {
+	age := now.Sub(sih.filtersStarted)
+	if age < storedPeerTTL {
+		return
+	}
+	if age < 2*storedPeerTTL {
+		sih.prevFilters = sih.filters
+	} else {
+		sih.prevFilters = scrapeFilters{}
+	}
+	sih.filters = scrapeFilters{}
+	sih.filtersStarted = now
+}
+
+type storedPeer struct {
+	util.CompactPeer
+	seed    bool
+	expires time.Time
+}
+
+// Adds or refreshes a peer for the infohash. Returns false if there's no
+// room for it.
+func (ps *peerStore) add(infoHash string, p util.CompactPeer, seed bool, now time.Time) bool {
+	if ps.infoHashes == nil {
+		ps.infoHashes = make(map[string]*storedInfoHash)
+	}
+	sih := ps.infoHashes[infoHash]
+	if sih == nil {
+		if len(ps.infoHashes) >= maxStoredInfoHashes {
+			ps.expire(now)
+			if len(ps.infoHashes) >= maxStoredInfoHashes {
+				return false
+			}
+		}
+		sih = &storedInfoHash{peers: make(map[string]storedPeer)}
+		ps.infoHashes[infoHash] = sih
+	}
+	sih.rotateFilters(now)
+	if seed {
+		sih.filters.seeds.AddIP(p.IP)
+	} else {
+		sih.filters.peers.AddIP(p.IP)
+	}
+	peers := sih.peers
+	key := (&Peer{p.IP, p.Port}).String()
+	if _, ok := peers[key]; !ok && len(peers) >= maxStoredPeersPerInfoHash {
+		ps.expireInfoHash(infoHash, now)
+		if len(peers) >= maxStoredPeersPerInfoHash {
+			ps.dropSoonestExpiring(peers)
+		}
+	}
+	peers[key] = storedPeer{p, seed, now.Add(storedPeerTTL)}
+	return true
+}
+
+func (ps *peerStore) dropSoonestExpiring(peers map[string]storedPeer) {
+	var (
+		key     string
+		expires time.Time
+	)
+	for k, p := range peers {
+		if key == "" || p.expires.Before(expires) {
+			key, expires = k, p.expires
+		}
+	}
+	delete(peers, key)
+}
+
+// Returns up to max unexpired peers for the infohash of the given address
+// family, leaving out seeds if noSeed is set.
+func (ps *peerStore) get(infoHash string, max int, ipv6, noSeed bool, now time.Time) (ret []util.CompactPeer) {
+	ps.expireInfoHash(infoHash, now)
+	sih := ps.infoHashes[infoHash]
+	if sih == nil {
+		return
+	}
+	for _, p := range sih.peers {
+		if len(ret) >= max {
+			break
+		}
+		if (p.IP.To4() == nil) != ipv6 || p.seed && noSeed {
+			continue
+		}
+		ret = append(ret, p.CompactPeer)
+	}
+	return
+}
+
+func (ps *peerStore) expireInfoHash(infoHash string, now time.Time) {
+	sih := ps.infoHashes[infoHash]
+	if sih == nil {
+		return
+	}
+	for k, p := range sih.peers {
+		if !now.Before(p.expires) {
+			delete(sih.peers, k)
+		}
+	}
+	if len(sih.peers) == 0 {
+		delete(ps.infoHashes, infoHash)
+	}
+}
+
+// Returns bloom filters of the seed and peer IPs that announced the
+// infohash recently.
+func (ps *peerStore) scrape(infoHash string, now time.Time) (seeds, peers krpc.ScrapeBloomFilter, ok bool) {
+	ps.expireInfoHash(infoHash, now)
+	sih := ps.infoHashes[infoHash]
+	if sih == nil {
+		return
+	}
+	sih.rotateFilters(now)
+	seeds, peers = sih.filters.seeds, sih.filters.peers
+	seeds.Merge(sih.prevFilters.seeds)
+	peers.Merge(sih.prevFilters.peers)
+	ok = true
+	return
+}
+
+func (ps *peerStore) expire(now time.Time) {
+	for ih := range ps.infoHashes {
+		ps.expireInfoHash(ih, now)
+	}
+}
+
+// Returns the number of infohashes and peers stored.
+func (ps *peerStore) len() (infoHashes, peers int) {
+	for _, sih := range ps.infoHashes {
+		peers += len(sih.peers)
+	}
+	return len(ps.infoHashes), peers
+}
+
+// Returns a random subset of the stored infohashes for sample_infohashes. The
+// same subset is returned until it's due to be refreshed.
+func (ps *peerStore) sample(now time.Time) krpc.CompactInfohashes {
+	if now.Sub(ps.samplesRefreshed) < sampleInfoHashesInterval {
+		return ps.samples
+	}
+	ps.expire(now)
+	ps.samples = nil
+	for ih := range ps.infoHashes {
+		var b [20]byte
+		copy(b[:], ih)
+		ps.samples = append(ps.samples, b)
+	}
+	for i := range ps.samples {
+		j := i + rand.Intn(len(ps.samples)-i)
+		ps.samples[i], ps.samples[j] = ps.samples[j], ps.samples[i]
+	}
+	if len(ps.samples) > maxSampledInfoHashes {
+		ps.samples = ps.samples[:maxSampledInfoHashes]
+	}
+	ps.samplesRefreshed = now
+	return ps.samples
+}
@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/util"
+)
+
+func TestPeerStore(t *testing.T) {
+	var ps peerStore
+	now := time.Now()
+	ih := "12341234123412341234"
+	p4 := util.CompactPeer{IP: net.ParseIP("1.2.3.4"), Port: 1}
+	p6 := util.CompactPeer{IP: net.ParseIP("2001:db8::1"), Port: 2}
+	assert.True(t, ps.add(ih, p4, false, now))
+	assert.True(t, ps.add(ih, p4, false, now))
+	assert.True(t, ps.add(ih, p6, false, now))
+	assert.EqualValues(t, []util.CompactPeer{p4}, ps.get(ih, 10, false, false, now))
+	assert.EqualValues(t, []util.CompactPeer{p6}, ps.get(ih, 10, true, false, now))
+	assert.Empty(t, ps.get("other", 10, false, false, now))
+	ihs, peers := ps.len()
+	assert.Equal(t, 1, ihs)
+	assert.Equal(t, 2, peers)
+	assert.Empty(t, ps.get(ih, 10, false, false, now.Add(storedPeerTTL)))
+	ihs, peers = ps.len()
+	assert.Equal(t, 0, ihs)
+	assert.Equal(t, 0, peers)
+}
+
+func TestPeerStoreBounded(t *testing.T) {
+	var ps peerStore
+	now := time.Now()
+	ih := "12341234123412341234"
+	for i := 0; i < maxStoredPeersPerInfoHash+10; i++ {
+		assert.True(t, ps.add(ih, util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: i + 1}, false, now.Add(time.Duration(i))))
+	}
+	_, peers := ps.len()
+	assert.Equal(t, maxStoredPeersPerInfoHash, peers)
+	for i := 1; i < maxStoredInfoHashes; i++ {
+		assert.True(t, ps.add(string(rune(i)), util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: 1}, false, now))
+	}
+	assert.False(t, ps.add("full", util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: 1}, false, now))
+	assert.True(t, ps.add("full", util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: 1}, false, now.Add(storedPeerTTL+time.Second)))
+}
+
+func TestTokens(t *testing.T) {
+	var ts tokenServer
+	now := time.Now()
+	ip := net.ParseIP("1.2.3.4")
+	tok := ts.create(ip, now)
+	assert.True(t, ts.valid(tok, ip, now))
+	assert.False(t, ts.valid(tok, net.ParseIP("1.2.3.5"), now))
+	assert.False(t, ts.valid("hi", ip, now))
+	// Still good after one rotation, but not two.
+	assert.True(t, ts.valid(tok, ip, now.Add(tokenRotateInterval)))
+	assert.False(t, ts.valid(tok, ip, now.Add(2*tokenRotateInterval)))
+}
+
+func TestPeerStoreSample(t *testing.T) {
+	var ps peerStore
+	now := time.Now()
+	assert.Empty(t, ps.sample(now))
+	now = now.Add(sampleInfoHashesInterval)
+	for i := 0; i < maxSampledInfoHashes+10; i++ {
+		var ih [20]byte
+		ih[0] = byte(i)
+		ps.add(string(ih[:]), util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: 1}, false, now)
+	}
+	samples := ps.sample(now)
+	assert.Len(t, samples, maxSampledInfoHashes)
+	seen := make(map[[20]byte]bool)
+	for _, ih := range samples {
+		assert.False(t, seen[ih])
+		seen[ih] = true
+		assert.Len(t, ps.infoHashes[string(ih[:])].peers, 1)
+	}
+	// The sample doesn't change until the interval passes.
+	ps.infoHashes = nil
+	assert.EqualValues(t, samples, ps.sample(now.Add(sampleInfoHashesInterval-1)))
+	assert.Empty(t, ps.sample(now.Add(sampleInfoHashesInterval)))
+}
+
+func TestPeerStoreScrape(t *testing.T) {
+	var ps peerStore
+	now := time.Now()
+	ih := "12341234123412341234"
+	_, _, ok := ps.scrape(ih, now)
+	assert.False(t, ok)
+	seed := util.CompactPeer{IP: net.IPv4(1, 2, 3, 4), Port: 1}
+	leecher := util.CompactPeer{IP: net.IPv4(5, 6, 7, 8), Port: 1}
+	ps.add(ih, seed, true, now)
+	ps.add(ih, leecher, false, now)
+	assert.EqualValues(t, []util.CompactPeer{leecher}, ps.get(ih, 10, false, true, now))
+	seeds, peers, ok := ps.scrape(ih, now)
+	require.True(t, ok)
+	assert.InDelta(t, 1, seeds.EstimateCount(), 0.01)
+	assert.InDelta(t, 1, peers.EstimateCount(), 0.01)
+	// The filters outlive the peers that were dropped to bound the store.
+	for i := 0; i < maxStoredPeersPerInfoHash; i++ {
+		ps.add(ih, util.CompactPeer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 1}, false, now)
+	}
+	_, peers, _ = ps.scrape(ih, now)
+	assert.InDelta(t, maxStoredPeersPerInfoHash+1, peers.EstimateCount(), 5)
+	// A rotation keeps the previous filters, but not two.
+	later := now.Add(storedPeerTTL)
+	ps.add(ih, leecher, false, later)
+	seeds, _, _ = ps.scrape(ih, later)
+	assert.InDelta(t, 1, seeds.EstimateCount(), 0.01)
+	later = later.Add(storedPeerTTL)
+	ps.add(ih, leecher, false, later)
+	seeds, peers, _ = ps.scrape(ih, later)
+	assert.EqualValues(t, 0, seeds.EstimateCount())
+	assert.InDelta(t, 1, peers.EstimateCount(), 0.01)
+}
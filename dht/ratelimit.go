@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/lovedboy/torrent/iplist"
+)
+
+// A token bucket that's refilled continuously. The zero value is full.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Takes a token if one is available. Tokens are added at rate per second, up
+// to burst.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Whether the bucket would be full by now, so forgetting it changes nothing.
+func (b *tokenBucket) idle(rate, burst float64, now time.Time) bool {
+	return b.tokens+now.Sub(b.updated).Seconds()*rate >= burst
+}
+
+// Limits the queries we answer, per source IP and in total.
+type queryLimiter struct {
+	perIP  map[string]*ipQueries // Keyed by IP.
+	global tokenBucket
+}
+
+type ipQueries struct {
+	tokenBucket
+	// Queries refused since the bucket was last full.
+	overruns int
+}
+
+// Returns whether a query from the IP should be answered. flood is set once
+// the IP has repeatedly exceeded its own limit, as opposed to the global one.
+func (ql *queryLimiter) allow(ip net.IP, now time.Time) (ok, flood bool) {
+	if b := ql.ipBucket(ip, now); b != nil {
+		if b.idle(perIPQueryRate, perIPQueryBurst, now) {
+			b.overruns = 0
+		}
+		if !b.take(perIPQueryRate, perIPQueryBurst, now) {
+			b.overruns++
+			if b.overruns < queryFloodOverruns {
+				return false, false
+			}
+			b.overruns = 0
+			return false, true
+		}
+	}
+	return ql.global.take(globalQueryRate, globalQueryBurst, now), false
+}
+
+// Returns the IP's bucket, or nil if there are too many IPs to track.
+func (ql *queryLimiter) ipBucket(ip net.IP, now time.Time) *ipQueries {
+	if ql.perIP == nil {
+		ql.perIP = make(map[string]*ipQueries)
+	}
+	key := string(ip.To16())
+	if b, ok := ql.perIP[key]; ok {
+		return b
+	}
+	if len(ql.perIP) >= maxRateLimitedIPs {
+		for k, b := range ql.perIP {
+			if b.idle(perIPQueryRate, perIPQueryBurst, now) {
+				delete(ql.perIP, k)
+			}
+		}
+		if len(ql.perIP) >= maxRateLimitedIPs {
+			return nil
+		}
+	}
+	b := new(ipQueries)
+	ql.perIP[key] = b
+	return b
+}
+
+// IPs that are ignored for a while for flooding us with queries. It's
+// consulted alongside the Server's IPBlocklist.
+type tempBlockList struct {
+	until map[string]time.Time // Keyed by IP.
+}
+
+var _ iplist.Ranger = &tempBlockList{}
+
+// Blocks the IP until the given time. Returns false if the list is full.
+func (bl *tempBlockList) block(ip net.IP, until time.Time) bool {
+	if bl.until == nil {
+		bl.until = make(map[string]time.Time)
+	}
+	key := string(ip.To16())
+	if _, ok := bl.until[key]; !ok && len(bl.until) >= maxTempBlockedIPs {
+		bl.expire(time.Now())
+		if len(bl.until) >= maxTempBlockedIPs {
+			return false
+		}
+	}
+	bl.until[key] = until
+	return true
+}
+
+func (bl *tempBlockList) expire(now time.Time) {
+	for k, until := range bl.until {
+		if !now.Before(until) {
+			delete(bl.until, k)
+		}
+	}
+}
+
+func (bl *tempBlockList) Lookup(ip net.IP) (r iplist.Range, ok bool) {
+	key := string(ip.To16())
+	until, ok := bl.until[key]
+	if !ok {
+		return
+	}
+	if !time.Now().Before(until) {
+		delete(bl.until, key)
+		ok = false
+		return
+	}
+	r = iplist.Range{
+		First:       ip,
+		Last:        ip,
+		Description: "dht query flood",
+	}
+	return
+}
+
+func (bl *tempBlockList) NumRanges() int {
+	return len(bl.until)
+}
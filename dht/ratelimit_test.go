@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.take(1, 3, now))
+	}
+	assert.False(t, b.take(1, 3, now))
+	assert.False(t, b.idle(1, 3, now))
+	assert.True(t, b.take(1, 3, now.Add(time.Second)))
+	assert.False(t, b.take(1, 3, now.Add(time.Second)))
+	assert.True(t, b.idle(1, 3, now.Add(4*time.Second)))
+}
+
+func TestQueryLimiter(t *testing.T) {
+	var ql queryLimiter
+	now := time.Now()
+	a := net.ParseIP("1.2.3.4")
+	for i := 0; i < perIPQueryBurst; i++ {
+		ok, flood := ql.allow(a, now)
+		assert.True(t, ok)
+		assert.False(t, flood)
+	}
+	// Going over the limit only counts as a flood once it's done repeatedly.
+	for i := 1; i < queryFloodOverruns; i++ {
+		ok, flood := ql.allow(a, now)
+		assert.False(t, ok)
+		assert.False(t, flood)
+	}
+	ok, flood := ql.allow(a, now)
+	assert.False(t, ok)
+	assert.True(t, flood)
+	// Overruns are forgotten once the IP is back within its limit.
+	later := now.Add(perIPQueryBurst / perIPQueryRate * time.Second)
+	for i := 0; i < perIPQueryBurst; i++ {
+		ok, _ = ql.allow(a, later)
+		assert.True(t, ok)
+	}
+	for i := 1; i < queryFloodOverruns; i++ {
+		_, flood = ql.allow(a, later)
+		assert.False(t, flood)
+	}
+	// Other IPs are unaffected until the global budget runs out.
+	ok, _ = ql.allow(net.ParseIP("1.2.3.5"), now)
+	assert.True(t, ok)
+	ql.global.tokens = 0
+	ok, flood = ql.allow(net.ParseIP("1.2.3.6"), now)
+	assert.False(t, ok)
+	assert.False(t, flood)
+}
+
+func TestTempBlockList(t *testing.T) {
+	var bl tempBlockList
+	ip := net.ParseIP("1.2.3.4")
+	_, ok := bl.Lookup(ip)
+	assert.False(t, ok)
+	assert.True(t, bl.block(ip, time.Now().Add(time.Minute)))
+	r, ok := bl.Lookup(net.IPv4(1, 2, 3, 4).To4())
+	assert.True(t, ok)
+	assert.Equal(t, "dht query flood", r.Description)
+	assert.Equal(t, 1, bl.NumRanges())
+	bl.block(ip, time.Now())
+	_, ok = bl.Lookup(ip)
+	assert.False(t, ok)
+	assert.Equal(t, 0, bl.NumRanges())
+}
+
+func TestServerBlocksQueryFlood(t *testing.T) {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	source := NewAddr(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < perIPQueryBurst; i++ {
+		assert.True(t, s.allowQuery(source))
+	}
+	for i := 0; i < queryFloodOverruns; i++ {
+		assert.False(t, s.ipBlocked(source.UDPAddr().IP))
+		assert.EqualValues(t, 0, s.badNodes.Count())
+		assert.False(t, s.allowQuery(source))
+	}
+	assert.True(t, s.ipBlocked(source.UDPAddr().IP))
+	assert.EqualValues(t, 1, s.badNodes.Count())
+}
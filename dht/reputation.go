@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"time"
+)
+
+// Counts the protocol violations of remote addresses, such as malformed
+// queries and replies. Violations are forgotten if an address commits none
+// for a while.
+type reputations struct {
+	m map[string]reputation // Keyed by address.
+}
+
+type reputation struct {
+	violations    int
+	lastViolation time.Time
+}
+
+// Records a violation by the address. Returns true if it has now committed
+// too many.
+func (rs *reputations) violation(addr string, now time.Time) bool {
+	if rs.m == nil {
+		rs.m = make(map[string]reputation)
+	}
+	r, ok := rs.m[addr]
+	if ok && now.Sub(r.lastViolation) >= protocolViolationMemory {
+		r = reputation{}
+	}
+	if !ok && len(rs.m) >= maxReputations {
+		rs.expire(now)
+		if len(rs.m) >= maxReputations {
+			return false
+		}
+	}
+	r.violations++
+	r.lastViolation = now
+	rs.m[addr] = r
+	return r.violations >= maxProtocolViolations
+}
+
+func (rs *reputations) expire(now time.Time) {
+	for k, r := range rs.m {
+		if now.Sub(r.lastViolation) >= protocolViolationMemory {
+			delete(rs.m, k)
+		}
+	}
+}
+
+// Returns the violations recorded for the address that haven't been
+// forgotten.
+func (rs *reputations) violations(addr string, now time.Time) int {
+	r, ok := rs.m[addr]
+	if !ok || now.Sub(r.lastViolation) >= protocolViolationMemory {
+		return 0
+	}
+	return r.violations
+}
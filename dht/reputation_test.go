@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/bencode"
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+func TestReputations(t *testing.T) {
+	var rs reputations
+	now := time.Now()
+	for i := 1; i < maxProtocolViolations; i++ {
+		assert.False(t, rs.violation("a", now))
+	}
+	assert.Equal(t, maxProtocolViolations-1, rs.violations("a", now))
+	assert.Equal(t, 0, rs.violations("b", now))
+	// Violations are forgotten after a quiet spell.
+	later := now.Add(protocolViolationMemory)
+	assert.Equal(t, 0, rs.violations("a", later))
+	assert.False(t, rs.violation("a", later))
+	for i := 1; i < maxProtocolViolations-1; i++ {
+		assert.False(t, rs.violation("a", later))
+	}
+	assert.True(t, rs.violation("a", later))
+}
+
+func TestServerRepliesProtocolErrors(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	srv0, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv0.Close()
+	addr := NewAddr(srv0.Addr().(*net.UDPAddr))
+	query := func(q string, args map[string]interface{}) int {
+		_, err := srv.Query(context.Background(), addr, q, args)
+		require.IsType(t, krpc.KRPCError{}, err)
+		return err.(krpc.KRPCError).Code
+	}
+	assert.Equal(t, krpc.ErrorCodeMethodUnknown, query("vote", nil))
+	assert.Equal(t, krpc.ErrorCodeProtocolError, query("find_node", map[string]interface{}{"target": "short"}))
+	assert.Equal(t, krpc.ErrorCodeProtocolError, query("announce_peer", map[string]interface{}{
+		"info_hash": "01234567890123456789",
+		"port":      1234,
+		"token":     "bogus",
+	}))
+	srv0.mu.Lock()
+	// Only the malformed target counts against the sender.
+	assert.Equal(t, 1, srv0.reputations.violations(srv.Addr().String(), time.Now()))
+	srv0.mu.Unlock()
+	for i := 1; i < maxProtocolViolations; i++ {
+		query("get_peers", map[string]interface{}{"info_hash": "short"})
+	}
+	srv0.mu.Lock()
+	defer srv0.mu.Unlock()
+	assert.EqualValues(t, 1, srv0.badNodes.Count())
+}
+
+func TestServerRepliesToMalformedQuery(t *testing.T) {
+	srv, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+	})
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	// The arguments aren't a dict, so it doesn't unmarshal as a krpc.Msg.
+	_, err = conn.WriteTo([]byte("d1:ai5e1:q4:ping1:t2:aa1:y1:qe"), srv.Addr())
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 0x10000)
+	n, _, err := conn.ReadFrom(b)
+	require.NoError(t, err)
+	var m krpc.Msg
+	require.NoError(t, bencode.Unmarshal(b[:n], &m))
+	assert.Equal(t, "aa", m.T)
+	assert.Equal(t, "e", m.Y)
+	require.NotNil(t, m.E)
+	assert.Equal(t, krpc.ErrorCodeProtocolError, m.E.Code)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	assert.Equal(t, 1, srv.reputations.violations(conn.LocalAddr().String(), time.Now()))
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+// Estimates of a swarm's size from a scrape.
+type ScrapeResult struct {
+	Seeders  int
+	Leechers int
+	// The bloom filters from all the responses, merged.
+	BFsd, BFpe krpc.ScrapeBloomFilter
+	TraversalStats
+}
+
+// Estimates the number of seeders and leechers for the infohash without
+// contacting them, per http://www.bittorrent.org/beps/bep_0033.html. The
+// nodes closest to the infohash are asked for bloom filters of the IPs that
+// announced to them, and the filters are merged.
+func (s *Server) Scrape(ctx context.Context, infoHash string) (ret ScrapeResult, err error) {
+	if len(infoHash) != 20 {
+		err = errors.New("infohash has bad length")
+		return
+	}
+	t := s.newTraversal(ctx, infoHash, func(ctx context.Context, addr Addr) (*krpc.Return, error) {
+		return s.queryLiftingNodes(ctx, addr, "get_peers", map[string]interface{}{
+			"info_hash": infoHash,
+			"want":      s.want(),
+			"scrape":    1,
+		})
+	})
+	t.onResponse = func(_ traversalNode, r *krpc.Return) {
+		if r.BFsd != nil {
+			ret.BFsd.Merge(*r.BFsd)
+		}
+		if r.BFpe != nil {
+			ret.BFpe.Merge(*r.BFpe)
+		}
+	}
+	t.run()
+	ret.Seeders = int(ret.BFsd.EstimateCount() + 0.5)
+	ret.Leechers = int(ret.BFpe.EstimateCount() + 0.5)
+	ret.TraversalStats = t.Stats()
+	return
+}
@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/util"
+)
+
+func TestScrape(t *testing.T) {
+	ss := newTestNetwork(t, 4)
+	defer closeAll(ss)
+	ih := "12341234123412341234"
+	store := func(s *Server, ip net.IP, seed bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.peerStore.add(ih, util.CompactPeer{IP: ip, Port: 1}, seed, time.Now())
+	}
+	store(ss[0], net.IPv4(1, 0, 0, 1), true)
+	store(ss[0], net.IPv4(1, 0, 0, 2), true)
+	store(ss[2], net.IPv4(1, 0, 0, 1), true)
+	store(ss[2], net.IPv4(2, 0, 0, 1), false)
+	store(ss[3], net.IPv4(2, 0, 0, 2), false)
+	sr, err := ss[1].Scrape(context.Background(), ih)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sr.Seeders)
+	assert.Equal(t, 2, sr.Leechers)
+	assert.Equal(t, 3, sr.NumResponses)
+	_, err = ss[1].Scrape(context.Background(), "short")
+	assert.Error(t, err)
+}
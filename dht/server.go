@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"context"
 	"crypto"
 	"encoding/binary"
 	"encoding/hex"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/missinggo"
@@ -18,8 +20,10 @@ import (
 
 	"github.com/lovedboy/torrent/bencode"
 	"github.com/lovedboy/torrent/dht/krpc"
+	"github.com/lovedboy/torrent/internal/ipvote"
 	"github.com/lovedboy/torrent/iplist"
 	"github.com/lovedboy/torrent/logonce"
+	"github.com/lovedboy/torrent/util"
 )
 
 // A Server defines parameters for a DHT node server that is able to
@@ -33,13 +37,22 @@ import (
 type Server struct {
 	id               string
 	socket           net.PacketConn
-	transactions     map[transactionKey]*Transaction
+	transactions     map[transactionKey]*transaction
+	inFlightQueries  map[string]int // Queries awaiting replies, by remote address.
 	transactionIDInt uint64
-	nodes            map[string]*node // Keyed by dHTAddr.String().
+	table            *table
 	mu               sync.Mutex
 	closed           missinggo.Event
 	ipBlockList      iplist.Ranger
 	badNodes         *boom.BloomFilter
+	tokens           tokenServer
+	peerStore        peerStore
+	items            itemStore
+	queryLimiter     queryLimiter
+	tempBlocks       tempBlockList
+	reputations      reputations
+	ipVotes          ipvote.Votes
+	externalIP       net.IP // Our IP as voted by other nodes.
 
 	numConfirmedAnnounces int
 	bootstrapNodes        []string
@@ -50,15 +63,13 @@ type Server struct {
 func (s *Server) Stats() (ss ServerStats) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, n := range s.nodes {
-		if n.DefinitelyGood() {
-			ss.GoodNodes++
-		}
-	}
-	ss.Nodes = len(s.nodes)
+	ss.GoodNodes = s.numGoodNodes()
+	ss.Nodes = s.table.len()
 	ss.OutstandingTransactions = len(s.transactions)
 	ss.ConfirmedAnnounces = s.numConfirmedAnnounces
 	ss.BadNodes = s.badNodes.Count()
+	ss.StoredInfoHashes, ss.StoredPeers = s.peerStore.len()
+	ss.StoredItems = s.items.len()
 	return
 }
 
@@ -95,10 +106,23 @@ func NewServer(c *ServerConfig) (s *Server, err error) {
 		}
 		s.id = string(rawID)
 	}
+	var state tableState
+	if c.StateFile != "" {
+		var ok bool
+		state, ok, err = loadStateFile(c.StateFile)
+		if err != nil {
+			err = fmt.Errorf("error loading state file: %s", err)
+			return
+		}
+		if ok && s.id == "" && len(state.ID) == 20 {
+			s.id = state.ID
+		}
+	}
 	err = s.init()
 	if err != nil {
 		return
 	}
+	s.addTableStateNodes(state)
 	go func() {
 		err := s.serve()
 		s.mu.Lock()
@@ -120,6 +144,7 @@ func NewServer(c *ServerConfig) (s *Server, err error) {
 			s.mu.Unlock()
 		}
 	}()
+	go s.refreshBuckets()
 	return
 }
 
@@ -144,7 +169,8 @@ func (s *Server) init() (err error) {
 	if err != nil {
 		return
 	}
-	s.transactions = make(map[transactionKey]*Transaction)
+	s.transactions = make(map[transactionKey]*transaction)
+	s.inFlightQueries = make(map[string]int)
 	return
 }
 
@@ -177,6 +203,7 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 			// 	log.Printf("%s: received bad krpc message from %s: %s: %+q", s, addr, err, b)
 			// }
 		}()
+		s.malformedMessage(b, addr)
 		return
 	}
 	s.mu.Lock()
@@ -186,6 +213,9 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 	}
 	if d.Y == "q" {
 		readQuery.Add(1)
+		if !s.allowQuery(addr) {
+			return
+		}
 		s.handleQuery(addr, d)
 		return
 	}
@@ -194,13 +224,80 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 		//log.Printf("unexpected message: %#v", d)
 		return
 	}
+	if !validReply(d) {
+		// The query will be resent or time out.
+		s.protocolViolation(addr)
+		return
+	}
+	if d.Y == "r" && d.IP.IP != nil {
+		s.voteExternalIP(addr, d.IP.IP)
+	}
 	node := s.getNode(addr, d.SenderID())
 	node.lastGotResponse = time.Now()
-	// TODO: Update node ID as this is an authoritative packet.
-	go t.handleResponse(d)
+	node.failedQueries = 0
+	s.table.responded(node, node.lastGotResponse)
+	t.reply <- d
 	s.deleteTransaction(t)
 }
 
+// Whether a reply to one of our queries is well formed.
+func validReply(m krpc.Msg) bool {
+	switch m.Y {
+	case "r":
+		return m.R != nil && len(m.R.ID) == 20
+	case "e":
+		return m.E != nil
+	}
+	return false
+}
+
+// Records a protocol violation by the address, and marks it bad if it has
+// committed too many.
+func (s *Server) protocolViolation(addr Addr) {
+	protocolViolations.Add(1)
+	if s.reputations.violation(addr.String(), time.Now()) {
+		s.badNode(addr)
+	}
+}
+
+// Replies to a malformed query with a protocol error, and counts it against
+// the sender.
+func (s *Server) badQuery(source Addr, t string, msg string) {
+	s.protocolViolation(source)
+	if s.config.Passive {
+		return
+	}
+	s.replyError(source, t, krpc.KRPCError{Code: krpc.ErrorCodeProtocolError, Msg: msg})
+}
+
+// Handles a message that didn't unmarshal as a krpc.Msg. If it's still
+// recognizably a query, the sender gets a protocol error and it's held
+// against them.
+func (s *Server) malformedMessage(b []byte, source Addr) {
+	var m struct {
+		T string `bencode:"t"`
+		Y string `bencode:"y"`
+	}
+	if bencode.Unmarshal(b, &m) != nil || m.Y != "q" || m.T == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.IsSet() {
+		return
+	}
+	readQuery.Add(1)
+	if !s.allowQuery(source) {
+		return
+	}
+	s.badQuery(source, m.T, "malformed query")
+}
+
+// Tokens expire, so a bad one isn't held against the sender.
+func (s *Server) replyBadToken(source Addr, t string) {
+	s.replyError(source, t, krpc.KRPCError{Code: krpc.ErrorCodeProtocolError, Msg: "bad token"})
+}
+
 func (s *Server) serve() error {
 	var b [0x10000]byte
 	for {
@@ -224,7 +321,27 @@ func (s *Server) serve() error {
 	}
 }
 
+// Applies the query rate limits. Sources that repeatedly exceed their own
+// limit are blocked for a while and treated as bad nodes. Going over it
+// occasionally only gets the query dropped.
+func (s *Server) allowQuery(source Addr) bool {
+	now := time.Now()
+	ip := source.UDPAddr().IP
+	ok, flood := s.queryLimiter.allow(ip, now)
+	if flood {
+		readQueryFlood.Add(1)
+		s.tempBlocks.block(ip, now.Add(queryFloodBlockDuration))
+		s.badNode(source)
+	} else if !ok {
+		readQueryOverBudget.Add(1)
+	}
+	return ok
+}
+
 func (s *Server) ipBlocked(ip net.IP) (blocked bool) {
+	if _, blocked = s.tempBlocks.Lookup(ip); blocked {
+		return
+	}
 	if s.ipBlockList == nil {
 		return
 	}
@@ -232,26 +349,86 @@ func (s *Server) ipBlocked(ip net.IP) (blocked bool) {
 	return
 }
 
-// Adds directly to the node table.
+// Adds directly to the node table. Nodes without an ID are pinged, and added
+// if they respond.
 func (s *Server) AddNode(ni krpc.NodeInfo) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.nodes == nil {
-		s.nodes = make(map[string]*node)
+	if !s.CanReach(ni.Addr.IP) {
+		return
+	}
+	if ni.ID == [20]byte{} {
+		s.queryAsync(NewAddr(ni.Addr), "ping", nil)
+		return
 	}
 	s.getNode(NewAddr(ni.Addr), string(ni.ID[:]))
 }
 
-func (s *Server) nodeByID(id string) *node {
-	for _, node := range s.nodes {
-		if node.idString() == id {
-			return node
+// Returns whether the server's socket can send to the IP's address family. A
+// socket bound to the unspecified IPv6 address is taken to be dual-stack.
+func (s *Server) CanReach(ip net.IP) bool {
+	local := missinggo.AddrIP(s.socket.LocalAddr())
+	if local == nil || local.Equal(net.IPv6unspecified) {
+		return true
+	}
+	return (local.To4() == nil) == (ip.To4() == nil)
+}
+
+// The "want" argument for queries returning nodes, per
+// http://www.bittorrent.org/beps/bep_0032.html.
+func (s *Server) want() (ret []string) {
+	if s.CanReach(net.IPv4zero) {
+		ret = append(ret, krpc.WantNodes)
+	}
+	if s.CanReach(net.IPv6zero) {
+		ret = append(ret, krpc.WantNodes6)
+	}
+	return
+}
+
+// Returns whether the querier wants IPv4 and IPv6 nodes. Without a "want"
+// argument, it gets the family it queried from.
+func wantNodes(source Addr, want []string) (n4, n6 bool) {
+	if len(want) == 0 {
+		n6 = source.UDPAddr().IP.To4() == nil
+		return !n6, n6
+	}
+	for _, w := range want {
+		switch w {
+		case krpc.WantNodes:
+			n4 = true
+		case krpc.WantNodes6:
+			n6 = true
+		}
+	}
+	return
+}
+
+// Sets the nodes in a reply to the closest good nodes to the target, in the
+// families the querier wants.
+func (s *Server) setReturnNodes(r *krpc.Return, source Addr, want []string, targetID string) {
+	n4, n6 := wantNodes(source, want)
+	if n4 {
+		for _, node := range s.closestGoodNodesFamily(8, targetID, false) {
+			r.Nodes = append(r.Nodes, node.NodeInfo())
+		}
+	}
+	if n6 {
+		for _, node := range s.closestGoodNodesFamily(8, targetID, true) {
+			r.Nodes6 = append(r.Nodes6, node.NodeInfo())
 		}
 	}
-	return nil
+}
+
+func (s *Server) nodeByID(id string) *node {
+	return s.table.getNodeByID(nodeIDFromString(id))
 }
 
 func (s *Server) handleQuery(source Addr, m krpc.Msg) {
+	if m.A == nil || len(m.A.ID) != 20 {
+		s.badQuery(source, m.T, "bad id")
+		return
+	}
 	node := s.getNode(source, m.SenderID())
 	node.lastGotQuery = time.Now()
 	if s.config.OnQuery != nil {
@@ -271,53 +448,118 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 	case "get_peers": // TODO: Extract common behaviour with find_node.
 		targetID := args.InfoHash
 		if len(targetID) != 20 {
-			break
-		}
-		var rNodes []krpc.NodeInfo
-		// TODO: Reply with "values" list if we have peers instead.
-		for _, node := range s.closestGoodNodes(8, targetID) {
-			rNodes = append(rNodes, node.NodeInfo())
-		}
-		s.reply(source, m.T, krpc.Return{
-			Nodes: rNodes,
-			// TODO: Generate this dynamically, and store it for the source.
-			Token: "hi",
-		})
+			s.badQuery(source, m.T, "bad info_hash")
+			return
+		}
+		ip := source.UDPAddr().IP
+		r := krpc.Return{
+			Token: s.tokens.create(ip, time.Now()),
+		}
+		r.Values = s.peerStore.get(targetID, maxReturnedPeers, ip.To4() == nil, args.NoSeed, time.Now())
+		if args.Scrape {
+			if seeds, peers, ok := s.peerStore.scrape(targetID, time.Now()); ok {
+				r.BFsd, r.BFpe = &seeds, &peers
+			}
+		}
+		if len(r.Values) == 0 {
+			s.setReturnNodes(&r, source, args.Want, targetID)
+		}
+		s.reply(source, m.T, r)
 	case "find_node": // TODO: Extract common behaviour with get_peers.
 		targetID := args.Target
 		if len(targetID) != 20 {
-			log.Printf("bad DHT query: %v", m)
+			s.badQuery(source, m.T, "bad target")
 			return
 		}
-		var rNodes []krpc.NodeInfo
+		var r krpc.Return
 		if node := s.nodeByID(targetID); node != nil {
-			rNodes = append(rNodes, node.NodeInfo())
-		} else {
-			// This will probably cause a crash for IPv6, but meh.
-			for _, node := range s.closestGoodNodes(8, targetID) {
-				rNodes = append(rNodes, node.NodeInfo())
+			if node.ipv6() {
+				r.Nodes6 = append(r.Nodes6, node.NodeInfo())
+			} else {
+				r.Nodes = append(r.Nodes, node.NodeInfo())
 			}
+		} else {
+			s.setReturnNodes(&r, source, args.Want, targetID)
 		}
-		s.reply(source, m.T, krpc.Return{
-			Nodes: rNodes,
-		})
+		s.reply(source, m.T, r)
 	case "announce_peer":
-		// TODO(anacrolix): Implement this lolz.
-		// log.Print(m)
-	case "vote":
-		// TODO(anacrolix): Or reject, I don't think I want this.
+		ua := source.UDPAddr()
+		if len(args.InfoHash) != 20 {
+			announceBadQuery.Add(1)
+			s.badQuery(source, m.T, "bad info_hash")
+			return
+		}
+		if !s.tokens.valid(args.Token, ua.IP, time.Now()) {
+			announceBadQuery.Add(1)
+			s.replyBadToken(source, m.T)
+			return
+		}
+		p := util.CompactPeer{IP: ua.IP, Port: args.Port}
+		if args.ImpliedPort {
+			p.Port = ua.Port
+		}
+		if p.Port <= 0 || p.Port > 0xffff {
+			announceBadQuery.Add(1)
+			s.badQuery(source, m.T, "bad port")
+			return
+		}
+		if !s.peerStore.add(args.InfoHash, p, args.Seed, time.Now()) {
+			announcePeerStoreFull.Add(1)
+		}
+		s.reply(source, m.T, krpc.Return{})
+	case "sample_infohashes":
+		if len(args.Target) != 20 {
+			s.badQuery(source, m.T, "bad target")
+			return
+		}
+		now := time.Now()
+		r := krpc.Return{
+			Interval: int(sampleInfoHashesInterval / time.Second),
+			Samples:  s.peerStore.sample(now),
+		}
+		r.Num, _ = s.peerStore.len()
+		s.setReturnNodes(&r, source, args.Want, args.Target)
+		s.reply(source, m.T, r)
+	case "get":
+		s.handleGet(source, m)
+	case "put":
+		s.handlePut(source, m)
 	default:
-		log.Printf("%s: not handling received query: q=%s", s, m.Q)
-		return
+		// Includes "vote", which isn't supported.
+		s.replyError(source, m.T, krpc.KRPCError{Code: krpc.ErrorCodeMethodUnknown, Msg: "method unknown"})
 	}
 }
 
 func (s *Server) reply(addr Addr, t string, r krpc.Return) {
-	r.ID = s.ID()
+	r.ID = s.localID()
+	m := krpc.Msg{
+		T:  t,
+		Y:  "r",
+		R:  &r,
+		IP: compactAddr(addr),
+	}
+	b, err := bencode.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	err = s.writeToNode(b, addr)
+	if err != nil {
+		log.Printf("error replying to %s: %s", addr, err)
+	}
+}
+
+// The "ip" field of replies, which tells the querier its external address.
+func compactAddr(addr Addr) util.CompactPeer {
+	ua := addr.UDPAddr()
+	return util.CompactPeer{IP: ua.IP, Port: ua.Port}
+}
+
+func (s *Server) replyError(addr Addr, t string, e krpc.KRPCError) {
 	m := krpc.Msg{
-		T: t,
-		Y: "r",
-		R: &r,
+		T:  t,
+		Y:  "e",
+		E:  &e,
+		IP: compactAddr(addr),
 	}
 	b, err := bencode.Marshal(m)
 	if err != nil {
@@ -330,25 +572,26 @@ func (s *Server) reply(addr Addr, t string, r krpc.Return) {
 }
 
 // Returns a node struct for the addr. It is taken from the table or created
-// and possibly added if required and meets validity constraints.
+// and possibly added if required and meets validity constraints. Nodes
+// without an ID can't be placed in the table.
 func (s *Server) getNode(addr Addr, id string) (n *node) {
 	addrStr := addr.String()
-	n = s.nodes[addrStr]
+	n = s.table.getNode(addrStr)
 	if n != nil {
-		if id != "" {
-			n.SetIDFromString(id)
+		if len(id) != 20 || id == n.idString() {
+			return
+		}
+		// The node's place in the table depends on its ID.
+		s.table.drop(n, time.Now())
+	} else {
+		n = &node{
+			addr: addr,
 		}
-		return
-	}
-	n = &node{
-		addr: addr,
-	}
-	if len(id) == 20 {
-		n.SetIDFromString(id)
 	}
-	if len(s.nodes) >= maxNodes {
+	if len(id) != 20 {
 		return
 	}
+	n.SetIDFromString(id)
 	// Exclude insecure nodes from the node table.
 	if !s.config.NoSecurity && !n.IsSecure() {
 		return
@@ -356,22 +599,24 @@ func (s *Server) getNode(addr Addr, id string) (n *node) {
 	if s.badNodes.Test([]byte(addrStr)) {
 		return
 	}
-	s.nodes[addrStr] = n
+	_, check := s.table.add(n, time.Now())
+	if check != nil && s.inFlightQueries[check.addr.String()] == 0 {
+		// The bucket is full. If this node doesn't respond, it'll be replaced
+		// from the cache.
+		s.queryAsync(check.addr, "ping", nil)
+	}
 	return
 }
 
 func (s *Server) nodeTimedOut(addr Addr) {
-	node, ok := s.nodes[addr.String()]
-	if !ok {
+	node := s.table.getNode(addr.String())
+	if node == nil {
 		return
 	}
-	if node.DefinitelyGood() {
-		return
+	node.failedQueries++
+	if node.state(time.Now()) == nodeBad {
+		s.table.drop(node, time.Now())
 	}
-	if len(s.nodes) < maxNodes {
-		return
-	}
-	delete(s.nodes, addr.String())
 }
 
 func (s *Server) writeToNode(b []byte, node Addr) (err error) {
@@ -393,7 +638,7 @@ func (s *Server) writeToNode(b []byte, node Addr) (err error) {
 	return
 }
 
-func (s *Server) findResponseTransaction(transactionID string, sourceNode Addr) *Transaction {
+func (s *Server) findResponseTransaction(transactionID string, sourceNode Addr) *transaction {
 	return s.transactions[transactionKey{
 		sourceNode.String(),
 		transactionID}]
@@ -406,81 +651,81 @@ func (s *Server) nextTransactionID() string {
 	return string(b[:n])
 }
 
-func (s *Server) deleteTransaction(t *Transaction) {
-	delete(s.transactions, t.key())
+func (s *Server) deleteTransaction(t *transaction) {
+	k := t.key()
+	if _, ok := s.transactions[k]; !ok {
+		return
+	}
+	delete(s.transactions, k)
+	addr := t.remoteAddr.String()
+	s.inFlightQueries[addr]--
+	if s.inFlightQueries[addr] == 0 {
+		delete(s.inFlightQueries, addr)
+	}
 }
 
-func (s *Server) addTransaction(t *Transaction) {
+func (s *Server) addTransaction(t *transaction) {
 	if _, ok := s.transactions[t.key()]; ok {
 		panic("transaction not unique")
 	}
 	s.transactions[t.key()] = t
+	s.inFlightQueries[t.remoteAddr.String()]++
+}
+
+// Returns the number of queries to the address awaiting replies.
+func (s *Server) NumInFlightQueries(addr net.Addr) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlightQueries[addr.String()]
 }
 
 // ID returns the 20-byte server ID. This is the ID used to communicate with the
-// DHT network.
+// DHT network. It changes if other nodes vote for a new external IP.
 func (s *Server) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localID()
+}
+
+// Returns the server ID, for callers that hold s.mu.
+func (s *Server) localID() string {
 	if len(s.id) != 20 {
 		panic("bad node id")
 	}
 	return s.id
 }
 
-func (s *Server) query(node Addr, q string, a map[string]interface{}, onResponse func(krpc.Msg)) (t *Transaction, err error) {
-	tid := s.nextTransactionID()
-	if a == nil {
-		a = make(map[string]interface{}, 1)
-	}
-	a["id"] = s.ID()
-	d := map[string]interface{}{
-		"t": tid,
-		"y": "q",
-		"q": q,
-		"a": a,
-	}
-	// BEP 43. Outgoing queries from uncontactiable nodes should contain
-	// "ro":1 in the top level dictionary.
-	if s.config.Passive {
-		d["ro"] = 1
-	}
-	b, err := bencode.Marshal(d)
-	if err != nil {
-		return
-	}
-	_t := &Transaction{
-		remoteAddr:  node,
-		t:           tid,
-		response:    make(chan krpc.Msg, 1),
-		done:        make(chan struct{}),
-		queryPacket: b,
-		s:           s,
-		onResponse:  onResponse,
-	}
-	err = _t.sendQuery()
-	if err != nil {
-		return
-	}
-	s.getNode(node, "").lastSentQuery = time.Now()
-	_t.mu.Lock()
-	_t.startTimer()
-	_t.mu.Unlock()
-	s.addTransaction(_t)
-	t = _t
-	return
+// Sends a ping query to the address given.
+func (s *Server) Ping(ctx context.Context, node *net.UDPAddr) (*krpc.Return, error) {
+	return s.Query(ctx, NewAddr(node), "ping", nil)
 }
 
-// Sends a ping query to the address given.
-func (s *Server) Ping(node *net.UDPAddr) (*Transaction, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.query(NewAddr(node), "ping", nil, nil)
+// Asks the node for a sample of the infohashes it has stored, per
+// http://www.bittorrent.org/beps/bep_0051.html. The response also contains the
+// nodes closest to the target, which is how the keyspace is walked.
+func (s *Server) SampleInfohashes(ctx context.Context, node *net.UDPAddr, target string) (*krpc.Return, error) {
+	return s.queryLiftingNodes(ctx, NewAddr(node), "sample_infohashes", map[string]interface{}{
+		"target": target,
+		"want":   s.want(),
+	})
 }
 
-func (s *Server) announcePeer(node Addr, infoHash string, port int, token string, impliedPort bool) (err error) {
+// Like Query, but the nodes in the reply are added to the table.
+func (s *Server) queryLiftingNodes(ctx context.Context, addr Addr, q string, args map[string]interface{}) (*krpc.Return, error) {
+	r, err := s.Query(ctx, addr, q, args)
+	if err == nil {
+		s.mu.Lock()
+		s.liftNodes(r)
+		s.mu.Unlock()
+	}
+	return r, err
+}
+
+func (s *Server) announcePeer(ctx context.Context, node Addr, infoHash string, port int, token string, impliedPort bool) (err error) {
 	if port == 0 && !impliedPort {
 		return errors.New("nothing to announce")
 	}
-	_, err = s.query(node, "announce_peer", map[string]interface{}{
+	_, err = s.Query(ctx, node, "announce_peer", map[string]interface{}{
 		"implied_port": func() int {
 			if impliedPort {
 				return 1
@@ -491,29 +736,27 @@ func (s *Server) announcePeer(node Addr, infoHash string, port int, token string
 		"info_hash": infoHash,
 		"port":      port,
 		"token":     token,
-	}, func(m krpc.Msg) {
-		if err := m.Error(); err != nil {
-			announceErrors.Add(1)
-			// log.Print(token)
-			// logonce.Stderr.Printf("announce_peer response: %s", err)
-			return
-		}
-		s.numConfirmedAnnounces++
 	})
+	if _, ok := err.(krpc.KRPCError); ok {
+		announceErrors.Add(1)
+	}
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.numConfirmedAnnounces++
+	s.mu.Unlock()
 	return
 }
 
 // Add response nodes to node table.
-func (s *Server) liftNodes(d krpc.Msg) {
-	if d.Y != "r" {
-		return
-	}
-	for _, cni := range d.R.Nodes {
+func (s *Server) liftNodes(r *krpc.Return) {
+	for _, cni := range r.AllNodes() {
 		if cni.Addr.Port == 0 {
 			// TODO: Why would people even do this?
 			continue
 		}
-		if s.ipBlocked(cni.Addr.IP) {
+		if s.ipBlocked(cni.Addr.IP) || !s.CanReach(cni.Addr.IP) {
 			continue
 		}
 		n := s.getNode(NewAddr(cni.Addr), string(cni.ID[:]))
@@ -522,91 +765,97 @@ func (s *Server) liftNodes(d krpc.Msg) {
 }
 
 // Sends a find_node query to addr. targetID is the node we're looking for.
-func (s *Server) findNode(addr Addr, targetID string) (t *Transaction, err error) {
-	t, err = s.query(addr, "find_node", map[string]interface{}{"target": targetID}, func(d krpc.Msg) {
-		// Scrape peers from the response to put in the server's table before
-		// handing the response back to the caller.
-		s.liftNodes(d)
+func (s *Server) findNode(ctx context.Context, addr Addr, targetID string) (*krpc.Return, error) {
+	return s.queryLiftingNodes(ctx, addr, "find_node", map[string]interface{}{
+		"target": targetID,
+		"want":   s.want(),
+	})
+}
+
+// Sends a get_peers query to addr.
+func (s *Server) getPeers(ctx context.Context, addr Addr, infoHash string) (*krpc.Return, error) {
+	return s.queryLiftingNodes(ctx, addr, "get_peers", map[string]interface{}{
+		"info_hash": infoHash,
+		"want":      s.want(),
 	})
-	if err != nil {
-		return
-	}
-	return
 }
 
-// Adds bootstrap nodes directly to table, if there's room. Node ID security
-// is bypassed, but the IP blocklist is not.
-func (s *Server) addRootNodes() error {
-	addrs, err := bootstrapAddrs(s.bootstrapNodes)
+// Returns the bootstrap nodes' addresses that aren't blocked. They're queried
+// directly, as their IDs aren't known to place them in the table.
+func (s *Server) rootAddrs() (ret []Addr, err error) {
+	addrs, err := s.bootstrapAddrs()
 	if err != nil {
-		return err
+		return
 	}
 	for _, addr := range addrs {
-		if len(s.nodes) >= maxNodes {
-			break
-		}
-		if s.nodes[addr.String()] != nil {
-			continue
-		}
 		if s.ipBlocked(addr.IP) {
 			log.Printf("dht root node is in the blocklist: %s", addr.IP)
 			continue
 		}
-		s.nodes[addr.String()] = &node{
-			addr: NewAddr(addr),
-		}
+		ret = append(ret, NewAddr(addr))
 	}
-	return nil
+	return
 }
 
 // Populates the node table.
 func (s *Server) bootstrap() (err error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if len(s.nodes) == 0 && !s.config.NoDefaultBootstrap {
-		err = s.addRootNodes()
+	var rootAddrs []Addr
+	if s.table.len() == 0 && !s.config.NoDefaultBootstrap {
+		rootAddrs, err = s.rootAddrs()
 	}
+	closed := s.closed.C()
+	s.mu.Unlock()
 	if err != nil {
 		return
 	}
 	for {
-		var outstanding sync.WaitGroup
-		for _, node := range s.nodes {
-			var t *Transaction
-			t, err = s.findNode(node.addr, s.id)
-			if err != nil {
-				err = fmt.Errorf("error sending find_node: %s", err)
-				return
-			}
-			outstanding.Add(1)
-			t.SetResponseHandler(func(krpc.Msg, bool) {
-				outstanding.Done()
-			})
-		}
-		noOutstanding := make(chan struct{})
-		go func() {
-			outstanding.Wait()
-			close(noOutstanding)
-		}()
+		s.mu.Lock()
+		addrs := append([]Addr(nil), rootAddrs...)
+		for _, node := range s.table.nodes() {
+			addrs = append(addrs, node.addr)
+		}
+		// The ID can change while the queries are in flight.
+		id := s.localID()
 		s.mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		var (
+			outstanding sync.WaitGroup
+			replied     int32
+		)
+		for _, addr := range addrs {
+			outstanding.Add(1)
+			go func(addr Addr) {
+				defer outstanding.Done()
+				if _, err := s.findNode(ctx, addr, id); err == nil {
+					atomic.AddInt32(&replied, 1)
+				}
+			}(addr)
+		}
+		outstanding.Wait()
+		cancel()
+		var wait time.Duration
+		if replied == 0 {
+			// Don't spin if the queries are failing quickly.
+			wait = 15 * time.Second
+		}
 		select {
-		case <-s.closed.LockedChan(&s.mu):
-			s.mu.Lock()
+		case <-closed:
 			return
-		case <-time.After(15 * time.Second):
-		case <-noOutstanding:
+		case <-time.After(wait):
 		}
 		s.mu.Lock()
-		// log.Printf("now have %d nodes", len(s.nodes))
-		if s.numGoodNodes() >= 160 {
-			break
+		// log.Printf("now have %d nodes", s.table.len())
+		numGood := s.numGoodNodes()
+		s.mu.Unlock()
+		if numGood >= 160 {
+			return
 		}
 	}
-	return
 }
 
 func (s *Server) numGoodNodes() (num int) {
-	for _, n := range s.nodes {
+	for _, n := range s.table.nodes() {
 		if n.DefinitelyGood() {
 			num++
 		}
@@ -618,14 +867,14 @@ func (s *Server) numGoodNodes() (num int) {
 func (s *Server) NumNodes() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return len(s.nodes)
+	return s.table.len()
 }
 
 // Exports the current node table.
 func (s *Server) Nodes() (nis []krpc.NodeInfo) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, node := range s.nodes {
+	for _, node := range s.table.nodes() {
 		// if !node.Good() {
 		// 	continue
 		// }
@@ -646,6 +895,11 @@ func (s *Server) Close() {
 	defer s.mu.Unlock()
 	s.closed.Set()
 	s.socket.Close()
+	if s.config.StateFile != "" {
+		if err := s.saveStateFile(); err != nil {
+			log.Printf("error saving dht state file: %s", err)
+		}
+	}
 }
 
 func (s *Server) setDefaults() (err error) {
@@ -674,21 +928,7 @@ func (s *Server) setDefaults() (err error) {
 		SecureNodeId(id[:], publicIP)
 		s.id = string(id[:])
 	}
-	s.nodes = make(map[string]*node, maxNodes)
-	return
-}
-
-func (s *Server) getPeers(addr Addr, infoHash string) (t *Transaction, err error) {
-	if len(infoHash) != 20 {
-		err = fmt.Errorf("infohash has bad length")
-		return
-	}
-	t, err = s.query(addr, "get_peers", map[string]interface{}{"info_hash": infoHash}, func(m krpc.Msg) {
-		s.liftNodes(m)
-		if m.R != nil && m.R.Token != "" {
-			s.getNode(addr, m.SenderID()).announceToken = m.R.Token
-		}
-	})
+	s.table = newTable(nodeIDFromString(s.id), bucketSize)
 	return
 }
 
@@ -696,25 +936,55 @@ func (s *Server) closestGoodNodes(k int, targetID string) []*node {
 	return s.closestNodes(k, nodeIDFromString(targetID), func(n *node) bool { return n.DefinitelyGood() })
 }
 
+func (s *Server) closestGoodNodesFamily(k int, targetID string, ipv6 bool) []*node {
+	return s.closestNodes(k, nodeIDFromString(targetID), func(n *node) bool {
+		return n.DefinitelyGood() && n.ipv6() == ipv6
+	})
+}
+
 func (s *Server) closestNodes(k int, target nodeID, filter func(*node) bool) []*node {
-	sel := newKClosestNodesSelector(k, target)
-	idNodes := make(map[string]*node, len(s.nodes))
-	for _, node := range s.nodes {
-		if !filter(node) {
-			continue
-		}
-		sel.Push(node.id)
-		idNodes[node.idString()] = node
+	return s.table.closest(k, target, filter)
+}
+
+// Resolves the bootstrap nodes in the address families the server can reach.
+func (s *Server) bootstrapAddrs() ([]*net.UDPAddr, error) {
+	var networks []string
+	if s.CanReach(net.IPv4zero) {
+		networks = append(networks, "udp4")
 	}
-	ids := sel.IDs()
-	ret := make([]*node, 0, len(ids))
-	for _, id := range ids {
-		ret = append(ret, idNodes[id.ByteString()])
+	if s.CanReach(net.IPv6zero) {
+		networks = append(networks, "udp6")
 	}
-	return ret
+	return bootstrapAddrs(networks, s.bootstrapNodes)
 }
 
 func (s *Server) badNode(addr Addr) {
 	s.badNodes.Add([]byte(addr.String()))
-	delete(s.nodes, addr.String())
+	if n := s.table.getNode(addr.String()); n != nil {
+		s.table.drop(n, time.Now())
+	}
+}
+
+// Periodically looks up a random ID in each bucket that hasn't changed in a
+// while, to keep the table fresh.
+func (s *Server) refreshBuckets() {
+	for {
+		select {
+		case <-s.closed.LockedChan(&s.mu):
+			return
+		case <-time.After(time.Minute):
+		}
+		s.mu.Lock()
+		now := time.Now()
+		for _, i := range s.table.staleBuckets(now) {
+			target := s.table.randomIDInBucket(i)
+			for _, n := range s.closestNodes(3, target, func(n *node) bool { return n.DefinitelyGood() }) {
+				go s.findNode(context.Background(), n.addr, target.ByteString())
+			}
+			// Don't refresh it again until the interval passes, even if
+			// nothing comes of this.
+			s.table.buckets[i].lastChanged = now
+		}
+		s.mu.Unlock()
+	}
 }
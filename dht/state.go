@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lovedboy/torrent/bencode"
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+// What's persisted by SaveTable, as a bencoded dict.
+type tableState struct {
+	ID     string                   `bencode:"id"`
+	Nodes  krpc.CompactIPv4NodeInfo `bencode:"nodes,omitempty"`
+	Nodes6 krpc.CompactIPv6NodeInfo `bencode:"nodes6,omitempty"`
+}
+
+// Returns the server's ID, and the nodes in the table that have responded to
+// us and aren't bad.
+func (s *Server) tableState() (ret tableState) {
+	ret.ID = s.id
+	now := time.Now()
+	for _, n := range s.table.nodes() {
+		if n.lastGotResponse.IsZero() || n.state(now) == nodeBad {
+			continue
+		}
+		if n.ipv6() {
+			ret.Nodes6 = append(ret.Nodes6, n.NodeInfo())
+		} else {
+			ret.Nodes = append(ret.Nodes, n.NodeInfo())
+		}
+	}
+	return
+}
+
+// Writes the server's node ID and the good nodes in its routing table, to be
+// restored with LoadTable or ServerConfig.StateFile.
+func (s *Server) SaveTable(w io.Writer) error {
+	s.mu.Lock()
+	st := s.tableState()
+	s.mu.Unlock()
+	return bencode.NewEncoder(w).Encode(st)
+}
+
+// Adds the nodes saved by SaveTable to the routing table. The saved node ID
+// isn't used, as the ID can't change once the server is created. To restore
+// it too, use ServerConfig.StateFile.
+func (s *Server) LoadTable(r io.Reader) error {
+	st, err := readTableState(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addTableStateNodes(st)
+	return nil
+}
+
+func readTableState(r io.Reader) (st tableState, err error) {
+	err = bencode.NewDecoder(r).Decode(&st)
+	return
+}
+
+func (s *Server) addTableStateNodes(st tableState) {
+	for _, ni := range append([]krpc.NodeInfo(st.Nodes), st.Nodes6...) {
+		if s.CanReach(ni.Addr.IP) {
+			s.getNode(NewAddr(ni.Addr), string(ni.ID[:]))
+		}
+	}
+}
+
+// Reads the state file, if there is one. Files that can't be decoded are
+// logged and ignored, so the server starts afresh.
+func loadStateFile(name string) (st tableState, ok bool, err error) {
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	decodeErr := bencode.Unmarshal(b, &st)
+	if decodeErr == nil {
+		ok = true
+		return
+	}
+	st = tableState{}
+	if len(b)%krpc.CompactIPv4NodeInfoLen == 0 {
+		// The commands' -tableFile used to hold just the concatenated
+		// compact infos of IPv4 nodes.
+		st.Nodes, decodeErr = unmarshalCompactIPv4Nodes(b)
+		if decodeErr == nil {
+			ok = true
+			return
+		}
+	}
+	log.Printf("ignoring state file %q: %s", name, decodeErr)
+	st = tableState{}
+	return
+}
+
+func unmarshalCompactIPv4Nodes(b []byte) (ret krpc.CompactIPv4NodeInfo, err error) {
+	for ; len(b) != 0; b = b[krpc.CompactIPv4NodeInfoLen:] {
+		var ni krpc.NodeInfo
+		err = ni.UnmarshalCompactIPv4(b[:krpc.CompactIPv4NodeInfoLen])
+		if err != nil {
+			return
+		}
+		ret = append(ret, ni)
+	}
+	return
+}
+
+// Writes the state file, replacing any previous one only once the new one is
+// complete.
+func (s *Server) saveStateFile() error {
+	name := s.config.StateFile
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	err = bencode.NewEncoder(f).Encode(s.tableState())
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+func testStateServer(t *testing.T, stateFile string) *Server {
+	s, err := NewServer(&ServerConfig{
+		Addr:               "127.0.0.1:0",
+		NoDefaultBootstrap: true,
+		StateFile:          stateFile,
+	})
+	require.NoError(t, err)
+	return s
+}
+
+// Adds a node that has responded to us, so it's saved.
+func addRespondedNode(s *Server, ni krpc.NodeInfo) {
+	s.AddNode(ni)
+	s.mu.Lock()
+	s.table.getNode(NewAddr(ni.Addr).String()).lastGotResponse = time.Now()
+	s.mu.Unlock()
+}
+
+var testStateNode = krpc.NodeInfo{
+	ID:   [20]byte{1, 2, 3},
+	Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2).To4(), Port: 1234},
+}
+
+func TestSaveLoadTable(t *testing.T) {
+	s := testStateServer(t, "")
+	defer s.Close()
+	addRespondedNode(s, testStateNode)
+	// This one hasn't responded, and isn't saved.
+	s.AddNode(krpc.NodeInfo{
+		ID:   [20]byte{4, 5, 6},
+		Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3).To4(), Port: 1234},
+	})
+	require.Equal(t, 2, s.NumNodes())
+	var buf bytes.Buffer
+	require.NoError(t, s.SaveTable(&buf))
+	s2 := testStateServer(t, "")
+	defer s2.Close()
+	require.NoError(t, s2.LoadTable(&buf))
+	assert.EqualValues(t, []krpc.NodeInfo{testStateNode}, s2.Nodes())
+	assert.NotEqual(t, s.ID(), s2.ID())
+}
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "dht")
+	s := testStateServer(t, name)
+	addRespondedNode(s, testStateNode)
+	s.Close()
+	s2 := testStateServer(t, name)
+	defer s2.Close()
+	assert.Equal(t, s.ID(), s2.ID())
+	assert.EqualValues(t, []krpc.NodeInfo{testStateNode}, s2.Nodes())
+}
+
+func TestLegacyStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "dht")
+	var b [krpc.CompactIPv4NodeInfoLen]byte
+	require.NoError(t, testStateNode.PutCompact(b[:]))
+	require.NoError(t, ioutil.WriteFile(name, b[:], 0666))
+	s := testStateServer(t, name)
+	defer s.Close()
+	assert.EqualValues(t, []krpc.NodeInfo{testStateNode}, s.Nodes())
+}
+
+func TestBadStateFileIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "dht")
+	require.NoError(t, ioutil.WriteFile(name, []byte("garbage"), 0666))
+	s := testStateServer(t, name)
+	defer s.Close()
+	assert.Equal(t, 0, s.NumNodes())
+}
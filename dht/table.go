@@ -0,0 +1,247 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+)
+
+// A Kademlia routing table, per http://www.bittorrent.org/beps/bep_0005.html.
+// Nodes are put in one of 160 buckets by the position of the highest bit in
+// which their ID differs from ours. Each bucket holds at most k nodes, and
+// keeps a cache of up to k more to replace them as they go bad.
+type table struct {
+	rootID  nodeID
+	k       int
+	buckets [160]bucket
+	// Nodes in the buckets, keyed by dHTAddr.String().
+	addrs map[string]*node
+}
+
+type bucket struct {
+	// Least recently added first.
+	nodes []*node
+	// Candidates to replace nodes that go bad, most recently seen last.
+	replacements []*node
+	// When a node was last added, replaced, or responded to a query.
+	lastChanged time.Time
+}
+
+func newTable(rootID nodeID, k int) *table {
+	return &table{
+		rootID: rootID,
+		k:      k,
+		addrs:  make(map[string]*node),
+	}
+}
+
+// Returns the bucket for the ID, or -1 if it's our own or unset.
+func (tbl *table) bucketIndex(id nodeID) int {
+	if id.IsUnset() {
+		return -1
+	}
+	d := tbl.rootID.Distance(&id)
+	return d.BitLen() - 1
+}
+
+func (tbl *table) getNode(addr string) *node {
+	return tbl.addrs[addr]
+}
+
+func (tbl *table) getNodeByID(id nodeID) *node {
+	i := tbl.bucketIndex(id)
+	if i < 0 {
+		return nil
+	}
+	for _, n := range tbl.buckets[i].nodes {
+		if n.id.i.Cmp(&id.i) == 0 {
+			return n
+		}
+	}
+	return nil
+}
+
+// Adds the node to its bucket. If the bucket is full, a bad node in it is
+// replaced, otherwise the node goes into the replacement cache. In that case,
+// the least recently seen questionable node is returned so it can be checked.
+func (tbl *table) add(n *node, now time.Time) (added bool, check *node) {
+	if n.id.IsUnset() || tbl.addrs[n.addr.String()] != nil {
+		return
+	}
+	i := tbl.bucketIndex(n.id)
+	if i < 0 {
+		return
+	}
+	b := &tbl.buckets[i]
+	if len(b.nodes) < tbl.k {
+		b.nodes = append(b.nodes, n)
+	} else if j := b.worst(now); j >= 0 && b.nodes[j].state(now) == nodeBad {
+		delete(tbl.addrs, b.nodes[j].addr.String())
+		b.nodes[j] = n
+	} else {
+		b.addReplacement(n, tbl.k)
+		if j >= 0 && b.nodes[j].state(now) == nodeQuestionable {
+			check = b.nodes[j]
+		}
+		return
+	}
+	tbl.addrs[n.addr.String()] = n
+	b.removeReplacement(n.addr.String())
+	b.lastChanged = now
+	added = true
+	return
+}
+
+// Returns the index of the node in the bucket that's most deserving of
+// replacement: bad before questionable before good, then least recently seen.
+func (b *bucket) worst(now time.Time) (ret int) {
+	ret = -1
+	for i, n := range b.nodes {
+		if ret < 0 {
+			ret = i
+			continue
+		}
+		w := b.nodes[ret]
+		if s, ws := n.state(now), w.state(now); s != ws {
+			if s > ws {
+				ret = i
+			}
+			continue
+		}
+		if n.lastSeen().Before(w.lastSeen()) {
+			ret = i
+		}
+	}
+	return
+}
+
+func (b *bucket) addReplacement(n *node, k int) {
+	b.removeReplacement(n.addr.String())
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > k {
+		b.replacements = b.replacements[len(b.replacements)-k:]
+	}
+}
+
+func (b *bucket) removeReplacement(addr string) {
+	for i, r := range b.replacements {
+		if r.addr.String() == addr {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+// Removes the node from the table, filling its place from the replacement
+// cache.
+func (tbl *table) drop(n *node, now time.Time) {
+	addr := n.addr.String()
+	if tbl.addrs[addr] != n {
+		return
+	}
+	delete(tbl.addrs, addr)
+	b := &tbl.buckets[tbl.bucketIndex(n.id)]
+	for i, bn := range b.nodes {
+		if bn == n {
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			break
+		}
+	}
+	for len(b.replacements) != 0 {
+		r := b.replacements[len(b.replacements)-1]
+		b.replacements = b.replacements[:len(b.replacements)-1]
+		if r.state(now) == nodeBad || tbl.addrs[r.addr.String()] != nil {
+			continue
+		}
+		b.nodes = append(b.nodes, r)
+		tbl.addrs[r.addr.String()] = r
+		break
+	}
+	b.lastChanged = now
+}
+
+// Notes that a node in the table responded to a query.
+func (tbl *table) responded(n *node, now time.Time) {
+	if tbl.addrs[n.addr.String()] != n {
+		return
+	}
+	tbl.buckets[tbl.bucketIndex(n.id)].lastChanged = now
+}
+
+// Returns the k nodes closest to the target that pass the filter. Buckets
+// are visited from nearest the target outward, so only as many are looked at
+// as needed.
+func (tbl *table) closest(k int, target nodeID, filter func(*node) bool) []*node {
+	sel := newKClosestNodesSelector(k, target)
+	byID := make(map[string]*node)
+	push := func(i int) {
+		for _, n := range tbl.buckets[i].nodes {
+			if filter(n) {
+				sel.Push(n.id)
+				byID[n.idString()] = n
+			}
+		}
+	}
+	// Nodes in the target's bucket are nearest, then all those in the buckets
+	// below it, which are equally far in the highest bit. Beyond that, each
+	// bucket is further than the last.
+	ti := tbl.bucketIndex(target)
+	if ti >= 0 {
+		push(ti)
+		if len(byID) < k {
+			for i := 0; i < ti; i++ {
+				push(i)
+			}
+		}
+	}
+	for i := ti + 1; i < len(tbl.buckets) && len(byID) < k; i++ {
+		push(i)
+	}
+	ids := sel.IDs()
+	ret := make([]*node, 0, len(ids))
+	for _, id := range ids {
+		ret = append(ret, byID[id.ByteString()])
+	}
+	return ret
+}
+
+func (tbl *table) len() int {
+	return len(tbl.addrs)
+}
+
+func (tbl *table) nodes() (ret []*node) {
+	for i := range tbl.buckets {
+		ret = append(ret, tbl.buckets[i].nodes...)
+	}
+	return
+}
+
+// Returns the non-empty buckets that haven't changed in the refresh
+// interval.
+func (tbl *table) staleBuckets(now time.Time) (ret []int) {
+	for i := range tbl.buckets {
+		b := &tbl.buckets[i]
+		if len(b.nodes) != 0 && now.Sub(b.lastChanged) >= bucketRefreshInterval {
+			ret = append(ret, i)
+		}
+	}
+	return
+}
+
+// Returns a random ID that falls in the bucket.
+func (tbl *table) randomIDInBucket(i int) (ret nodeID) {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	var d big.Int
+	d.SetBytes(b[:])
+	// Keep the bits below i, and set bit i.
+	d.SetBit(&d, i, 1)
+	for j := i + 1; j < 160; j++ {
+		d.SetBit(&d, j, 0)
+	}
+	ret.i.Xor(&tbl.rootID.i, &d)
+	ret.set = true
+	return
+}
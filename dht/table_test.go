@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTableNode(id string, port int) *node {
+	n := &node{
+		addr: NewAddr(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: port}),
+	}
+	n.SetIDFromString(id)
+	return n
+}
+
+func TestTableBucketIndex(t *testing.T) {
+	tbl := newTable(nodeIDFromString(zeroID), bucketSize)
+	assert.Equal(t, -1, tbl.bucketIndex(nodeIDFromString(zeroID)))
+	assert.Equal(t, -1, tbl.bucketIndex(nodeIDFromString("")))
+	assert.Equal(t, 0, tbl.bucketIndex(nodeIDFromString(zeroID[:19]+"\x01")))
+	assert.Equal(t, 159, tbl.bucketIndex(nodeIDFromString("\x80"+zeroID[1:])))
+	for _, i := range []int{0, 1, 7, 8, 100, 159} {
+		assert.Equal(t, i, tbl.bucketIndex(tbl.randomIDInBucket(i)))
+	}
+}
+
+func TestTableFullBucket(t *testing.T) {
+	now := time.Now()
+	tbl := newTable(nodeIDFromString(zeroID), 2)
+	a := testTableNode("\x80"+zeroID[1:], 1)
+	b := testTableNode("\x81"+zeroID[1:], 2)
+	c := testTableNode("\x82"+zeroID[1:], 3)
+	added, _ := tbl.add(a, now)
+	assert.True(t, added)
+	b.lastGotResponse = now
+	added, _ = tbl.add(b, now)
+	assert.True(t, added)
+	// The bucket is full, so c is cached, and the questionable node should be
+	// checked.
+	added, check := tbl.add(c, now)
+	assert.False(t, added)
+	assert.Equal(t, a, check)
+	assert.Equal(t, 2, tbl.len())
+	assert.Nil(t, tbl.getNode(c.addr.String()))
+	// a goes bad, and is replaced by c.
+	a.failedQueries = maxNodeFailures
+	tbl.drop(a, now)
+	assert.Equal(t, 2, tbl.len())
+	assert.Equal(t, c, tbl.getNode(c.addr.String()))
+	assert.Nil(t, tbl.getNode(a.addr.String()))
+	assert.Equal(t, c, tbl.getNodeByID(c.id))
+	// A bad node in a full bucket is replaced directly.
+	c.failedQueries = maxNodeFailures
+	d := testTableNode("\x83"+zeroID[1:], 4)
+	added, _ = tbl.add(d, now)
+	assert.True(t, added)
+	assert.Nil(t, tbl.getNode(c.addr.String()))
+	assert.Equal(t, d, tbl.getNode(d.addr.String()))
+}
+
+func TestTableClosest(t *testing.T) {
+	tbl := newTable(nodeIDFromString(zeroID), bucketSize)
+	var all []*node
+	for i := 0; i < 500; i++ {
+		var id [20]byte
+		rand.Read(id[:])
+		// Skew the IDs toward our own, so that many buckets have nodes.
+		id[0] >>= uint(rand.Intn(8))
+		n := testTableNode(string(id[:]), i+1)
+		if added, _ := tbl.add(n, time.Now()); added {
+			all = append(all, n)
+		}
+	}
+	require.Equal(t, len(all), tbl.len())
+	for i := 0; i < 20; i++ {
+		var b [20]byte
+		rand.Read(b[:])
+		target := nodeIDFromString(string(b[:]))
+		sel := newKClosestNodesSelector(8, target)
+		for _, n := range all {
+			sel.Push(n.id)
+		}
+		expected := make(map[string]bool)
+		for _, id := range sel.IDs() {
+			expected[id.ByteString()] = true
+		}
+		actual := make(map[string]bool)
+		for _, n := range tbl.closest(8, target, func(*node) bool { return true }) {
+			actual[n.idString()] = true
+		}
+		assert.Equal(t, expected, actual)
+	}
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"time"
+)
+
+// Issues the tokens returned by get_peers and checks them in announce_peer.
+// A token is a hash of the requester's IP and a secret that's replaced every
+// tokenRotateInterval. Tokens from the previous secret are still accepted, so
+// a token is good for at least one interval.
+type tokenServer struct {
+	secret     [20]byte
+	prevSecret [20]byte
+	rotated    time.Time
+}
+
+func (ts *tokenServer) rotate(now time.Time) {
+	if now.Sub(ts.rotated) < tokenRotateInterval {
+		return
+	}
+	if ts.rotated.IsZero() || now.Sub(ts.rotated) >= 2*tokenRotateInterval {
+		// Nothing issued from the current secret can still be valid.
+		ts.prevSecret = randomSecret()
+	} else {
+		ts.prevSecret = ts.secret
+	}
+	ts.secret = randomSecret()
+	ts.rotated = now
+}
+
+func randomSecret() (ret [20]byte) {
+	if _, err := rand.Read(ret[:]); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip)
+	return string(h.Sum(nil)[:8])
+}
+
+// Returns a token for the IP to use in announce_peer.
+func (ts *tokenServer) create(ip net.IP, now time.Time) string {
+	ts.rotate(now)
+	return tokenFor(ts.secret, ip)
+}
+
+// Returns whether the token was recently issued to the IP.
+func (ts *tokenServer) valid(token string, ip net.IP, now time.Time) bool {
+	ts.rotate(now)
+	return token == tokenFor(ts.secret, ip) || token == tokenFor(ts.prevSecret, ip)
+}
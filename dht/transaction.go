@@ -1,150 +1,142 @@
 package dht
 
 import (
-	"sync"
+	"context"
+	"errors"
 	"time"
 
+	"github.com/lovedboy/torrent/bencode"
 	"github.com/lovedboy/torrent/dht/krpc"
 )
 
-// Transaction keeps track of a message exchange between nodes, such as a
-// query message and a response message.
-type Transaction struct {
-	mu             sync.Mutex
-	remoteAddr     Addr
-	t              string
-	response       chan krpc.Msg
-	onResponse     func(krpc.Msg) // Called with the server locked.
-	done           chan struct{}
-	queryPacket    []byte
-	timer          *time.Timer
-	s              *Server
-	retries        int
-	lastSend       time.Time
-	userOnResponse func(krpc.Msg, bool)
-}
-
-// SetResponseHandler sets up a function to be called when the query response
-// is available.
-func (t *Transaction) SetResponseHandler(f func(krpc.Msg, bool)) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.userOnResponse = f
-	t.tryHandleResponse()
-}
+var (
+	// Returned by queries that got no reply after all their tries.
+	ErrQueryTimedOut = errors.New("query timed out")
+	errServerClosed  = errors.New("server closed")
+)
 
-func (t *Transaction) tryHandleResponse() {
-	if t.userOnResponse == nil {
-		return
-	}
-	select {
-	case r, ok := <-t.response:
-		t.userOnResponse(r, ok)
-		// Shouldn't be called more than once.
-		t.userOnResponse = nil
-	default:
-	}
+// A query awaiting its reply.
+type transaction struct {
+	remoteAddr Addr
+	t          string
+	// Receives the reply. It's buffered so the server never blocks on it.
+	reply chan krpc.Msg
 }
 
-func (t *Transaction) key() transactionKey {
+func (t *transaction) key() transactionKey {
 	return transactionKey{
 		t.remoteAddr.String(),
 		t.t,
 	}
 }
 
-func (t *Transaction) startTimer() {
-	t.timer = time.AfterFunc(jitterDuration(queryResendEvery, time.Second), t.timerCallback)
-}
-
-func (t *Transaction) timerCallback() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	select {
-	case <-t.done:
-		return
-	default:
-	}
-	if t.retries == 2 {
-		t.timeout()
-		return
-	}
-	t.retries++
-	t.sendQuery()
-	if t.timer.Reset(jitterDuration(queryResendEvery, time.Second)) {
-		panic("timer should have fired to get here")
+// Sends the query to the node and waits for the reply. The query is resent if
+// there's no reply within the resend delay, up to the configured number of
+// tries. A reply that's an error is returned as a krpc.KRPCError. Must not be
+// called with the server locked.
+func (s *Server) Query(ctx context.Context, addr Addr, q string, args map[string]interface{}) (*krpc.Return, error) {
+	s.mu.Lock()
+	t, b, err := s.newTransaction(addr, q, args)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
+	return s.awaitReply(ctx, t, b)
 }
 
-func (t *Transaction) sendQuery() error {
-	err := t.s.writeToNode(t.queryPacket, t.remoteAddr)
+// Sends the query without waiting for the reply. It's counted as in flight
+// immediately. Must be called with the server locked.
+func (s *Server) queryAsync(addr Addr, q string, args map[string]interface{}) {
+	t, b, err := s.newTransaction(addr, q, args)
 	if err != nil {
-		return err
+		return
 	}
-	t.lastSend = time.Now()
-	return nil
+	go s.awaitReply(context.Background(), t, b)
 }
 
-func (t *Transaction) timeout() {
-	go func() {
-		t.s.mu.Lock()
-		defer t.s.mu.Unlock()
-		t.s.nodeTimedOut(t.remoteAddr)
+// Sends the query packet for the transaction until there's a reply.
+func (s *Server) awaitReply(ctx context.Context, t *transaction, b []byte) (*krpc.Return, error) {
+	closed := s.closed.LockedChan(&s.mu)
+	defer func() {
+		s.mu.Lock()
+		s.deleteTransaction(t)
+		s.mu.Unlock()
 	}()
-	t.close()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for tries := 0; ; tries++ {
+		select {
+		case m := <-t.reply:
+			if e := m.Error(); e != nil {
+				return nil, *e
+			}
+			if m.R == nil {
+				return nil, errors.New("reply has no return")
+			}
+			return m.R, nil
+		case <-timer.C:
+			if tries == s.queryTries() {
+				s.mu.Lock()
+				s.nodeTimedOut(t.remoteAddr)
+				s.mu.Unlock()
+				return nil, ErrQueryTimedOut
+			}
+			if err := s.writeToNode(b, t.remoteAddr); err != nil {
+				return nil, err
+			}
+			d := s.queryResendDelay()
+			timer.Reset(jitterDuration(d, d/5))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-closed:
+			return nil, errServerClosed
+		}
+	}
 }
 
-func (t *Transaction) close() {
-	if t.closing() {
+// Registers a transaction for the query, and returns the packet to send.
+func (s *Server) newTransaction(addr Addr, q string, args map[string]interface{}) (t *transaction, b []byte, err error) {
+	tid := s.nextTransactionID()
+	a := make(map[string]interface{}, len(args)+1)
+	for k, v := range args {
+		a[k] = v
+	}
+	a["id"] = s.localID()
+	d := map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": q,
+		"a": a,
+	}
+	// BEP 43. Outgoing queries from uncontactiable nodes should contain
+	// "ro":1 in the top level dictionary.
+	if s.config.Passive {
+		d["ro"] = 1
+	}
+	b, err = bencode.Marshal(d)
+	if err != nil {
 		return
 	}
-	t.queryPacket = nil
-	close(t.response)
-	t.tryHandleResponse()
-	close(t.done)
-	t.timer.Stop()
-	go func() {
-		t.s.mu.Lock()
-		defer t.s.mu.Unlock()
-		t.s.deleteTransaction(t)
-	}()
-}
-
-func (t *Transaction) closing() bool {
-	select {
-	case <-t.done:
-		return true
-	default:
-		return false
+	t = &transaction{
+		remoteAddr: addr,
+		t:          tid,
+		reply:      make(chan krpc.Msg, 1),
 	}
+	s.getNode(addr, "").lastSentQuery = time.Now()
+	s.addTransaction(t)
+	return
 }
 
-// Close (abandon) the transaction.
-func (t *Transaction) Close() {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	t.close()
+func (s *Server) queryResendDelay() time.Duration {
+	if s.config.QueryResendDelay != 0 {
+		return s.config.QueryResendDelay
+	}
+	return defaultQueryResendDelay
 }
 
-func (t *Transaction) handleResponse(m krpc.Msg) {
-	t.mu.Lock()
-	if t.closing() {
-		t.mu.Unlock()
-		return
-	}
-	close(t.done)
-	t.mu.Unlock()
-	if t.onResponse != nil {
-		t.s.mu.Lock()
-		t.onResponse(m)
-		t.s.mu.Unlock()
-	}
-	t.queryPacket = nil
-	select {
-	case t.response <- m:
-	default:
-		panic("blocked handling response")
+func (s *Server) queryTries() int {
+	if s.config.QueryTries != 0 {
+		return s.config.QueryTries
 	}
-	close(t.response)
-	t.tryHandleResponse()
+	return defaultQueryTries
 }
@@ -0,0 +1,214 @@
+package dht
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+// How many queries a traversal has outstanding at once.
+const traversalAlpha = 3
+
+// A node met during a traversal.
+type traversalNode struct {
+	addr Addr
+	id   nodeID
+	// The token from the node's response, if any.
+	token string
+}
+
+func (n *traversalNode) NodeInfo() (ret krpc.NodeInfo) {
+	ret.Addr = n.addr.UDPAddr()
+	copy(ret.ID[:], n.id.ByteString())
+	return
+}
+
+type traversalResponse struct {
+	node traversalNode
+	r    *krpc.Return
+	err  error
+}
+
+// Statistics for a traversal of the DHT toward a target.
+type TraversalStats struct {
+	// Distinct nodes queried.
+	NumQueried int
+	// Queries that got a response.
+	NumResponses int
+}
+
+// An iterative lookup of the nodes closest to a target. Queries go to the
+// closest candidates not yet queried, traversalAlpha at a time, and the nodes
+// in the responses become candidates. It ends when no candidate is closer
+// than the k closest nodes that have responded.
+type traversal struct {
+	s      *Server
+	ctx    context.Context
+	target nodeID
+	query  func(context.Context, Addr) (*krpc.Return, error)
+	// Called with each response if not nil.
+	onResponse func(traversalNode, *krpc.Return)
+
+	k         int
+	pending   []traversalNode
+	seen      map[string]struct{}
+	closest   []traversalNode
+	inFlight  int
+	responses chan traversalResponse
+
+	mu    sync.Mutex
+	stats TraversalStats
+}
+
+// The traversal ends early if ctx is done.
+func (s *Server) newTraversal(ctx context.Context, target string, query func(context.Context, Addr) (*krpc.Return, error)) *traversal {
+	return &traversal{
+		s:      s,
+		ctx:    ctx,
+		target: nodeIDFromString(target),
+		query:  query,
+		k:      bucketSize,
+		seen:   make(map[string]struct{}),
+		// Each query sends one response, so this never blocks.
+		responses: make(chan traversalResponse, traversalAlpha),
+	}
+}
+
+func (t *traversal) Stats() TraversalStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+func (t *traversal) addCandidate(n traversalNode) {
+	if _, ok := t.seen[n.addr.String()]; ok {
+		return
+	}
+	t.seen[n.addr.String()] = struct{}{}
+	t.pending = append(t.pending, n)
+}
+
+// Starts from the closest nodes in the routing table, or the root nodes if
+// there are none.
+func (t *traversal) addStartNodes() {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.closestGoodNodes(t.k, t.target.ByteString()) {
+		t.addCandidate(traversalNode{addr: n.addr, id: n.id})
+	}
+	if len(t.pending) == 0 && !s.config.NoDefaultBootstrap {
+		addrs, _ := s.rootAddrs()
+		for _, addr := range addrs {
+			t.addCandidate(traversalNode{addr: addr})
+		}
+	}
+}
+
+// Runs the traversal to completion. Returns up to k of the closest nodes that
+// responded, nearest first.
+func (t *traversal) run() []traversalNode {
+	t.addStartNodes()
+	for {
+		t.sendQueries()
+		if t.inFlight == 0 {
+			return t.closest
+		}
+		select {
+		case r := <-t.responses:
+			t.inFlight--
+			t.handleResponse(r)
+		case <-t.ctx.Done():
+			return t.closest
+		}
+	}
+}
+
+func (t *traversal) sendQueries() {
+	sort.Sort(traversalNodesByDistance{t.pending, t.target})
+	for t.inFlight < traversalAlpha && len(t.pending) != 0 {
+		c := t.pending[0]
+		if len(t.closest) >= t.k && !traversalCloser(c.id, t.closest[t.k-1].id, t.target) {
+			// Nothing left that could be among the closest.
+			t.pending = nil
+			return
+		}
+		t.pending = t.pending[1:]
+		t.inFlight++
+		t.mu.Lock()
+		t.stats.NumQueried++
+		t.mu.Unlock()
+		go func() {
+			r, err := t.query(t.ctx, c.addr)
+			t.responses <- traversalResponse{c, r, err}
+		}()
+	}
+}
+
+func (t *traversal) handleResponse(r traversalResponse) {
+	if r.err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.stats.NumResponses++
+	t.mu.Unlock()
+	n := r.node
+	if len(r.r.ID) == 20 {
+		n.id = nodeIDFromString(r.r.ID)
+	}
+	n.token = r.r.Token
+	if t.onResponse != nil {
+		t.onResponse(n, r.r)
+	}
+	t.closest = append(t.closest, n)
+	sort.Sort(traversalNodesByDistance{t.closest, t.target})
+	if len(t.closest) > t.k {
+		t.closest = t.closest[:t.k]
+	}
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ni := range r.r.AllNodes() {
+		addr := NewAddr(ni.Addr)
+		if !validNodeAddr(addr) || !s.CanReach(ni.Addr.IP) || s.ipBlocked(ni.Addr.IP) {
+			continue
+		}
+		if string(ni.ID[:]) == s.id || s.badNodes.Test([]byte(addr.String())) {
+			continue
+		}
+		t.addCandidate(traversalNode{addr: addr, id: nodeIDFromString(string(ni.ID[:]))})
+	}
+}
+
+// Finds the nodes closest to the target ID, nearest first.
+func (s *Server) FindNode(ctx context.Context, target string) (ret []krpc.NodeInfo, stats TraversalStats) {
+	t := s.newTraversal(ctx, target, func(ctx context.Context, addr Addr) (*krpc.Return, error) {
+		return s.findNode(ctx, addr, target)
+	})
+	for _, n := range t.run() {
+		ret = append(ret, n.NodeInfo())
+	}
+	return ret, t.Stats()
+}
+
+// Whether a is closer to the target than b. Unset IDs are furthest.
+func traversalCloser(a, b, target nodeID) bool {
+	da := a.Distance(&target)
+	db := b.Distance(&target)
+	return da.Cmp(&db) < 0
+}
+
+type traversalNodesByDistance struct {
+	nodes  []traversalNode
+	target nodeID
+}
+
+func (me traversalNodesByDistance) Len() int { return len(me.nodes) }
+func (me traversalNodesByDistance) Swap(i, j int) {
+	me.nodes[i], me.nodes[j] = me.nodes[j], me.nodes[i]
+}
+func (me traversalNodesByDistance) Less(i, j int) bool {
+	return traversalCloser(me.nodes[i].id, me.nodes[j].id, me.target)
+}
@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/dht/krpc"
+)
+
+func nodeInfoOf(s *Server) (ni krpc.NodeInfo) {
+	ni.Addr = s.Addr().(*net.UDPAddr)
+	copy(ni.ID[:], s.ID())
+	return
+}
+
+// Returns servers that only know of the first, which knows them all. Keep n
+// small enough that the first server's buckets can't fill.
+func newTestNetwork(t *testing.T, n int) (ret []*Server) {
+	for i := 0; i < n; i++ {
+		s, err := NewServer(&ServerConfig{
+			Addr:               "127.0.0.1:0",
+			NoDefaultBootstrap: true,
+		})
+		require.NoError(t, err)
+		ret = append(ret, s)
+	}
+	for _, s := range ret[1:] {
+		s.AddNode(nodeInfoOf(ret[0]))
+		ret[0].AddNode(nodeInfoOf(s))
+	}
+	return
+}
+
+func closeAll(ss []*Server) {
+	for _, s := range ss {
+		s.Close()
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	ss := newTestNetwork(t, 8)
+	defer closeAll(ss)
+	target := ss[5].ID()
+	nis, stats := ss[1].FindNode(context.Background(), target)
+	require.NotEmpty(t, nis)
+	assert.Equal(t, target, string(nis[0].ID[:]))
+	assert.True(t, len(nis) <= bucketSize)
+	for _, ni := range nis {
+		assert.NotEqual(t, ss[1].ID(), string(ni.ID[:]))
+	}
+	assert.True(t, stats.NumQueried >= 2)
+	assert.True(t, stats.NumResponses >= 2)
+	assert.True(t, stats.NumResponses <= stats.NumQueried)
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	ss := newTestNetwork(t, 6)
+	defer closeAll(ss)
+	ih := "12341234123412341234"
+	a, err := ss[1].Announce(ih, 1234, false)
+	require.NoError(t, err)
+	for range a.Peers {
+	}
+	assert.NotZero(t, a.NumContacted())
+	// The announce_peer queries aren't waited on.
+	for i := 0; ; i++ {
+		stored := 0
+		for _, s := range ss {
+			stored += s.Stats().StoredPeers
+		}
+		if stored != 0 {
+			break
+		}
+		require.True(t, i < 100)
+		time.Sleep(10 * time.Millisecond)
+	}
+	gp, err := ss[2].GetPeers(ih)
+	require.NoError(t, err)
+	var peers []Peer
+	for pv := range gp.Peers {
+		peers = append(peers, pv.Peers...)
+	}
+	require.NotEmpty(t, peers)
+	assert.EqualValues(t, 1234, peers[0].Port)
+	_, err = ss[2].GetPeers("short")
+	assert.Error(t, err)
+}
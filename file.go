@@ -9,6 +9,7 @@ import (
 // Provides access to regions of torrent data that correspond to its files.
 type File struct {
 	t      *Torrent
+	index  int
 	path   string
 	offset int64
 	length int64
@@ -75,9 +76,10 @@ func (f *File) State() (ret []FilePieceState) {
 	return
 }
 
-// Requests that all pieces containing data in the file be downloaded.
+// Requests that all pieces containing data in the file be downloaded. This
+// sets the file's priority to FilePriorityNormal.
 func (f *File) Download() {
-	f.t.DownloadPieces(f.t.byteRegionPieces(f.offset, f.length))
+	f.SetPriority(FilePriorityNormal)
 }
 
 // Requests that torrent pieces containing bytes in the given region of the
@@ -96,6 +98,35 @@ func (f *File) exclusivePieces() (begin, end int) {
 	return byteRegionExclusivePieces(f.offset, f.length, int64(f.t.usualPieceSize()))
 }
 
+// Stops downloading the pieces that only contain data in the file. This sets
+// the file's priority to FilePriorityNone.
 func (f *File) Cancel() {
-	f.t.CancelPieces(f.exclusivePieces())
+	f.SetPriority(FilePriorityNone)
+}
+
+// Whether a file's data is wanted. It's retained in resume data.
+type FilePriority byte
+
+const (
+	// No priority has been set. Pieces are only downloaded as they're
+	// requested by other means.
+	FilePriorityDefault FilePriority = iota
+	// Don't download the file. Its pieces are left out of
+	// Torrent.DownloadAll.
+	FilePriorityNone
+	// Download the whole file.
+	FilePriorityNormal
+)
+
+// Sets the file's priority, pending or cancelling its pieces to match.
+func (f *File) SetPriority(prio FilePriority) {
+	f.t.cl.mu.Lock()
+	defer f.t.cl.mu.Unlock()
+	f.t.setFilePriority(f.index, prio)
+}
+
+func (f *File) Priority() FilePriority {
+	f.t.cl.mu.Lock()
+	defer f.t.cl.mu.Unlock()
+	return f.t.filePriorities[f.index]
 }
@@ -51,6 +51,27 @@ const (
 	pexExtendedId
 )
 
+const (
+	defaultUploadSlots = 4
+	// How often upload slots are reassigned, and how often the optimistic
+	// unchoke moves to another peer.
+	chokeInterval             = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+
+	// Outstanding chunk requests per web seed. They're merged into range
+	// requests where they're contiguous.
+	webSeedMaxRequests = 64
+	// How long to wait before using a web seed again after an error.
+	webSeedRetryInterval = time.Minute
+	// The longest a web seed request can take, including reading the body.
+	webSeedRequestTimeout = time.Minute
+
+	// BEP 11 limits PEX messages to one a minute, with up to 50 peers in
+	// each of the added and dropped lists.
+	pexInterval = time.Minute
+	pexMaxPeers = 50
+)
+
 // I could move a lot of these counters to their own file, but I suspect they
 // may be attached to a Client someday.
 var (
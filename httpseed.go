@@ -0,0 +1,77 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+// Adds HTTP seeds by URL, per http://www.bittorrent.org/beps/bep_0017.html.
+// Unlike web seeds, these are scripts that serve ranges of pieces.
+func (t *Torrent) AddHTTPSeeds(urls []string) {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.addHTTPSeeds(urls)
+}
+
+func (t *Torrent) addHTTPSeeds(urls []string) {
+	for _, u := range urls {
+		t.addWebSeed(u, true)
+	}
+}
+
+// An HTTP seed is busy, and asked to be retried later.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (me retryAfterError) Error() string {
+	return fmt.Sprintf("seed busy, retry after %s", me.wait)
+}
+
+// Returns the URL to request the given range of a piece from an HTTP seed.
+// The end of the range is inclusive.
+func httpSeedURL(base string, ih metainfo.Hash, piece int, begin, end int64) string {
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%sinfo_hash=%s&piece=%d&ranges=%d-%d",
+		base, sep, url.QueryEscape(string(ih[:])), piece, begin, end)
+}
+
+// Fills b with the piece data starting at begin from a BEP 17 HTTP seed.
+func (ws *webSeed) getPieceRange(ctx context.Context, ih metainfo.Hash, piece int, b []byte, begin int64) error {
+	req, err := http.NewRequest("GET", httpSeedURL(ws.url, ih, piece, begin, begin+int64(len(b))-1), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ws.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		// The body is the number of seconds to wait before trying again.
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+		secs, err := strconv.ParseUint(strings.TrimSpace(string(body)), 10, 32)
+		if err != nil {
+			return fmt.Errorf("seed busy, bad retry value %q", body)
+		}
+		return retryAfterError{time.Duration(secs) * time.Second}
+	default:
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, b)
+	return err
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/internal/testutil"
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func TestHTTPSeedURL(t *testing.T) {
+	var ih metainfo.Hash
+	ih[0] = '&'
+	assert.Equal(t,
+		"http://a/seed.php?x=1&info_hash=%26%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&piece=3&ranges=5-9",
+		httpSeedURL("http://a/seed.php?x=1", ih, 3, 5, 9))
+}
+
+func TestHTTPSeedRetryAfter(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "30")
+	}))
+	defer s.Close()
+	ws := webSeed{url: s.URL, client: webSeedHTTPClient, httpSeed: true}
+	err := ws.getPieceRange(context.Background(), metainfo.Hash{}, 0, make([]byte, 1), 0)
+	assert.Equal(t, retryAfterError{30 * time.Second}, err)
+}
+
+// Serves the greeting torrent like a BEP 17 seed script, telling the client
+// to retry the first time.
+func greetingHTTPSeed(t *testing.T, mi *metainfo.MetaInfo) http.Handler {
+	var mu sync.Mutex
+	busy := true
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		wasBusy := busy
+		busy = false
+		mu.Unlock()
+		if wasBusy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "0")
+			return
+		}
+		// This runs on the server's goroutine, so failures are reported to
+		// the client as a bad request rather than stopping the test here.
+		q := r.URL.Query()
+		piece, err := strconv.ParseInt(q.Get("piece"), 10, 0)
+		ends := strings.Split(q.Get("ranges"), "-")
+		if !assert.Equal(t, string(mi.Info.Hash().Bytes()), q.Get("info_hash")) ||
+			!assert.NoError(t, err) ||
+			!assert.Len(t, ends, 2) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		begin, _ := strconv.ParseInt(ends[0], 10, 0)
+		end, _ := strconv.ParseInt(ends[1], 10, 0)
+		off := piece * mi.Info.PieceLength
+		fmt.Fprint(w, testutil.GreetingFileContents[off+begin:off+end+1])
+	})
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	mi := testutil.GreetingMetaInfo()
+	s := httptest.NewServer(greetingHTTPSeed(t, mi))
+	defer s.Close()
+	cfg := TestingConfig
+	var err error
+	cfg.DataDir, err = ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(cfg.DataDir)
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	mi.HTTPSeeds = []string{s.URL + "/seed"}
+	spec := TorrentSpecFromMetaInfo(mi)
+	spec.ChunkSize = 2
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	r := tt.NewReader()
+	defer r.Close()
+	// Requests the seed rejects are retried after a long wait, so give up
+	// rather than hanging.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b := make([]byte, len(testutil.GreetingFileContents))
+	for n := 0; n < len(b); {
+		m, err := r.ReadContext(b[n:], ctx)
+		require.NoError(t, err)
+		n += m
+	}
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+}
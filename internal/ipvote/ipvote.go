@@ -0,0 +1,88 @@
+// Package ipvote tallies the external IP that other hosts report for us, such
+// as DHT nodes per http://www.bittorrent.org/beps/bep_0042.html, or peers in
+// the "yourip" field of http://www.bittorrent.org/beps/bep_0010.html.
+package ipvote
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// An IP is only believed once it has this many unexpired votes.
+	MinVotes = 5
+	// How long a vote counts.
+	VoteTTL = 30 * time.Minute
+	// The most voters tracked at once.
+	MaxVoters = 100
+)
+
+// Each voter IP has a single vote, which expires. The zero value is ready to
+// use. It's not safe for concurrent use.
+type Votes struct {
+	votes map[string]vote // Keyed by voter IP.
+}
+
+type vote struct {
+	ip   net.IP
+	when time.Time
+}
+
+// Records the voter's report of our IP, replacing any earlier one.
+func (iv *Votes) Vote(voter, ip net.IP, now time.Time) {
+	if iv.votes == nil {
+		iv.votes = make(map[string]vote)
+	}
+	key := string(voter.To16())
+	if _, ok := iv.votes[key]; !ok && len(iv.votes) >= MaxVoters {
+		iv.expire(now)
+		if len(iv.votes) >= MaxVoters {
+			iv.dropOldest()
+		}
+	}
+	iv.votes[key] = vote{ip, now}
+}
+
+func (iv *Votes) expire(now time.Time) {
+	for k, v := range iv.votes {
+		if now.Sub(v.when) >= VoteTTL {
+			delete(iv.votes, k)
+		}
+	}
+}
+
+func (iv *Votes) dropOldest() {
+	var oldest string
+	first := true
+	for k, v := range iv.votes {
+		if first || v.when.Before(iv.votes[oldest].when) {
+			oldest = k
+			first = false
+		}
+	}
+	delete(iv.votes, oldest)
+}
+
+// Returns the IP with the most unexpired votes, if it has at least MinVotes.
+// The current IP wins ties, so the result doesn't flap.
+func (iv *Votes) Winner(current net.IP, now time.Time) net.IP {
+	counts := make(map[string]int)
+	for _, v := range iv.votes {
+		if now.Sub(v.when) < VoteTTL {
+			counts[string(v.ip.To16())]++
+		}
+	}
+	best := ""
+	if current != nil {
+		best = string(current.To16())
+	}
+	for ip, n := range counts {
+		if n > counts[best] {
+			best = ip
+		}
+	}
+	if counts[best] < MinVotes {
+		return nil
+	}
+	return net.IP(best)
+}
@@ -0,0 +1,44 @@
+package ipvote
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVotes(t *testing.T) {
+	var iv Votes
+	now := time.Now()
+	a := net.IPv4(1, 2, 3, 4)
+	b := net.IPv4(5, 6, 7, 8)
+	for i := 0; i < MinVotes-1; i++ {
+		iv.Vote(net.IPv4(10, 0, 0, byte(i)), a, now)
+	}
+	assert.Nil(t, iv.Winner(nil, now))
+	// Voters only get one vote.
+	iv.Vote(net.IPv4(10, 0, 0, 0), a, now)
+	assert.Nil(t, iv.Winner(nil, now))
+	iv.Vote(net.IPv4(10, 0, 1, 0), a, now)
+	assert.True(t, a.Equal(iv.Winner(nil, now)))
+	for i := 0; i < MinVotes; i++ {
+		iv.Vote(net.IPv4(10, 0, 2, byte(i)), b, now)
+	}
+	// Ties go to the current IP.
+	assert.True(t, a.Equal(iv.Winner(a, now)))
+	iv.Vote(net.IPv4(10, 0, 0, 0), b, now)
+	assert.True(t, b.Equal(iv.Winner(a, now)))
+	assert.Nil(t, iv.Winner(a, now.Add(VoteTTL)))
+}
+
+func TestVotesBounded(t *testing.T) {
+	var iv Votes
+	now := time.Now()
+	for i := 0; i < MaxVoters+10; i++ {
+		iv.Vote(net.IPv4(10, 0, byte(i>>8), byte(i)), net.IPv4(1, 2, 3, 4), now.Add(time.Duration(i)))
+	}
+	assert.Len(t, iv.votes, MaxVoters)
+	_, ok := iv.votes[string(net.IPv4(10, 0, 0, 0).To16())]
+	assert.False(t, ok)
+}
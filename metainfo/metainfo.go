@@ -212,15 +212,17 @@ func (info *Info) UpvertedFiles() []FileInfo {
 }
 
 type MetaInfo struct {
-	Info         InfoEx      `bencode:"info"`
-	Announce     string      `bencode:"announce,omitempty"`
-	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
-	Nodes        []Node      `bencode:"nodes,omitempty"`
-	CreationDate int64       `bencode:"creation date,omitempty"`
-	Comment      string      `bencode:"comment,omitempty"`
-	CreatedBy    string      `bencode:"created by,omitempty"`
-	Encoding     string      `bencode:"encoding,omitempty"`
-	URLList      interface{} `bencode:"url-list,omitempty"`
+	Info         InfoEx     `bencode:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Nodes        []Node     `bencode:"nodes,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	Encoding     string     `bencode:"encoding,omitempty"`
+	URLList      URLList    `bencode:"url-list,omitempty"`
+	// BEP 17 HTTP seed URLs.
+	HTTPSeeds []string `bencode:"httpseeds,omitempty"`
 }
 
 // Encode to bencoded form.
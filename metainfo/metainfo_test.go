@@ -68,3 +68,14 @@ func TestNumPieces(t *testing.T) {
 		assert.EqualValues(t, _case.NumPieces, info.NumPieces())
 	}
 }
+
+func TestURLList(t *testing.T) {
+	mi, err := LoadFromFile("testdata/archlinux-2011.08.19-netinstall-i686.iso.torrent")
+	require.NoError(t, err)
+	require.NotEmpty(t, mi.URLList)
+	assert.Equal(t, "http://mirrors.kernel.org/archlinux/iso/2011.08.19/", mi.URLList[0])
+	var ul URLList
+	require.NoError(t, bencode.Unmarshal([]byte("17:http://a.com/file"), &ul))
+	assert.EqualValues(t, URLList{"http://a.com/file"}, ul)
+	assert.Error(t, bencode.Unmarshal([]byte("i42e"), &ul))
+}
@@ -22,3 +22,7 @@ func (p Piece) Hash() (ret Hash) {
 	missinggo.CopyExact(&ret, p.Info.Pieces[p.i*20:(p.i+1)*20])
 	return
 }
+
+func (p Piece) Index() int {
+	return p.i
+}
@@ -0,0 +1,7 @@
+package metainfo
+
+// Uniquely identifies a piece across all torrents.
+type PieceKey struct {
+	InfoHash Hash
+	Index    int
+}
@@ -0,0 +1,41 @@
+package metainfo
+
+import (
+	"fmt"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+// The "url-list" of web seeds, per BEP 19. It can be given as a single
+// string or a list of strings.
+type URLList []string
+
+var (
+	_ bencode.Unmarshaler = new(URLList)
+)
+
+func (me *URLList) UnmarshalBencode(b []byte) (err error) {
+	var iface interface{}
+	err = bencode.Unmarshal(b, &iface)
+	if err != nil {
+		return
+	}
+	switch v := iface.(type) {
+	case string:
+		if v != "" {
+			*me = URLList{v}
+		}
+	case []interface{}:
+		*me = nil
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return fmt.Errorf("unsupported url-list element type: %T", e)
+			}
+			*me = append(*me, s)
+		}
+	default:
+		err = fmt.Errorf("unsupported type: %T", iface)
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"net"
+)
+
+// A snapshot of the state of a connection to a peer. It doesn't change after
+// it's returned.
+type PeerConn struct {
+	RemoteAddr net.Addr
+	// One of "tcp", "utp", or "http" for web seeds.
+	Transport string
+	Encrypted bool
+	Source    PeerSource
+
+	PeerID [20]byte
+	// From the "v" field in the extended handshake, if any.
+	PeerClientName string
+
+	// We're choking the peer, and interested in what it has.
+	Choked     bool
+	Interested bool
+	// The peer is choking us, and is interested in what we have.
+	PeerChoked     bool
+	PeerInterested bool
+
+	// Outstanding requests we've sent the peer, and that it's sent us.
+	Requests     int
+	PeerRequests int
+
+	// The pieces the peer has, indexed by piece. This is nil if the torrent
+	// info isn't known yet.
+	PeerPieces []bool
+	// The number of pieces the peer has.
+	PeerNumPieces int
+
+	Stats ConnStats
+	// Recent payload rates in bytes per second.
+	DownloadRate float64
+	UploadRate   float64
+}
+
+// Returns snapshots of the torrent's active peer connections.
+func (t *Torrent) PeerConns() (ret []PeerConn) {
+	t.cl.mu.RLock()
+	defer t.cl.mu.RUnlock()
+	for _, c := range t.conns {
+		ret = append(ret, c.snapshot())
+	}
+	return
+}
+
+func (cn *connection) transport() string {
+	if cn.webSeed != nil {
+		return "http"
+	}
+	if cn.uTP {
+		return "utp"
+	}
+	return "tcp"
+}
+
+func (cn *connection) snapshot() (ret PeerConn) {
+	ret = PeerConn{
+		RemoteAddr:     cn.remoteAddr(),
+		Transport:      cn.transport(),
+		Encrypted:      cn.encrypted,
+		Source:         cn.Discovery,
+		PeerID:         cn.PeerID,
+		PeerClientName: cn.PeerClientName,
+		Choked:         cn.Choked,
+		Interested:     cn.Interested,
+		PeerChoked:     cn.PeerChoked,
+		PeerInterested: cn.PeerInterested,
+		Requests:       len(cn.Requests),
+		PeerRequests:   len(cn.PeerRequests),
+		Stats:          cn.stats,
+		DownloadRate:   cn.downloadRate.Rate(),
+		UploadRate:     cn.uploadRate.Rate(),
+	}
+	if cn.t.haveInfo() {
+		ret.PeerPieces = make([]bool, cn.t.numPieces())
+		for i := range ret.PeerPieces {
+			if cn.PeerHasPiece(i) {
+				ret.PeerPieces[i] = true
+				ret.PeerNumPieces++
+			}
+		}
+	} else if cn.peerHasAll {
+		ret.PeerNumPieces = cn.bestPeerNumPieces()
+	} else {
+		ret.PeerNumPieces = cn.peerPieces.Len()
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func TestPeerConnsSnapshot(t *testing.T) {
+	tor := &Torrent{
+		cl:     &Client{},
+		info:   &metainfo.InfoEx{Info: metainfo.Info{Pieces: make([]byte, 3*20)}},
+		pieces: make([]piece, 3),
+	}
+	r, w := net.Pipe()
+	defer r.Close()
+	defer w.Close()
+	c := &connection{
+		t:              tor,
+		conn:           r,
+		uTP:            true,
+		Discovery:      PeerSourcePEX,
+		PeerClientName: "test",
+		Choked:         true,
+		PeerInterested: true,
+		downloadRate:   rollingRate{rate: 3},
+	}
+	c.peerPieces.Add(2)
+	tor.conns = append(tor.conns, c)
+	pcs := tor.PeerConns()
+	assert.Len(t, pcs, 1)
+	pc := pcs[0]
+	assert.Equal(t, "utp", pc.Transport)
+	assert.Equal(t, PeerSourcePEX, pc.Source)
+	assert.Equal(t, "pex", pc.Source.String())
+	assert.Equal(t, "test", pc.PeerClientName)
+	assert.True(t, pc.Choked)
+	assert.True(t, pc.PeerInterested)
+	assert.False(t, pc.PeerChoked)
+	assert.EqualValues(t, 3, pc.DownloadRate)
+	assert.Equal(t, []bool{false, false, true}, pc.PeerPieces)
+	assert.Equal(t, 1, pc.PeerNumPieces)
+	// The snapshot doesn't follow the connection.
+	c.Choked = false
+	assert.True(t, pc.Choked)
+}
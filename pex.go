@@ -1,9 +1,216 @@
 package torrent
 
-import "github.com/lovedboy/torrent/util"
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/anacrolix/missinggo"
+
+	"github.com/lovedboy/torrent/bencode"
+	pp "github.com/lovedboy/torrent/peer_protocol"
+	"github.com/lovedboy/torrent/util"
+)
 
 type peerExchangeMessage struct {
-	Added      util.CompactIPv4Peers `bencode:"added"`
-	AddedFlags []byte                `bencode:"added.f"`
-	Dropped    util.CompactIPv4Peers `bencode:"dropped"`
+	Added       util.CompactIPv4Peers `bencode:"added"`
+	AddedFlags  []byte                `bencode:"added.f"`
+	Dropped     util.CompactIPv4Peers `bencode:"dropped"`
+	Added6      util.CompactIPv6Peers `bencode:"added6,omitempty"`
+	Added6Flags []byte                `bencode:"added6.f,omitempty"`
+	Dropped6    util.CompactIPv6Peers `bencode:"dropped6,omitempty"`
+}
+
+// Returns the peers added by the message, with the flags that were given.
+func (pem *peerExchangeMessage) addedPeers() (ret []Peer) {
+	add := func(cps []util.CompactPeer, flags []byte) {
+		for i, cp := range cps {
+			p := Peer{
+				IP:     cp.IP,
+				Port:   cp.Port,
+				Source: PeerSourcePEX,
+			}
+			if i < len(flags) && flags[i]&pexPrefersEncryption != 0 {
+				p.SupportsEncryption = true
+			}
+			ret = append(ret, p)
+		}
+	}
+	add(pem.Added, pem.AddedFlags)
+	add(pem.Added6, pem.Added6Flags)
+	return
+}
+
+// Flags for each peer in the "added.f" field, per
+// http://www.bittorrent.org/beps/bep_0011.html.
+const (
+	pexPrefersEncryption = 0x01
+	pexSeedUploadOnly    = 0x02
+	pexSupportsUTP       = 0x04
+	pexSupportsHolepunch = 0x08
+	pexOutgoingConn      = 0x10
+)
+
+// A peer that could be advertised in a PEX message.
+type pexPeer struct {
+	addr  util.CompactPeer
+	flags byte
+}
+
+// The PEX state for a connection.
+type pexConnState struct {
+	// The peers we've told the connection about, keyed by address.
+	sent map[string]util.CompactPeer
+}
+
+// Periodically sends PEX messages to the connections that support them,
+// until the torrent is closed.
+func (t *Torrent) runPEX() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed.LockedChan(&t.cl.mu):
+			return
+		case <-ticker.C:
+		}
+		t.cl.mu.Lock()
+		t.sendPEX()
+		t.cl.mu.Unlock()
+	}
+}
+
+func (t *Torrent) pexAllowed() bool {
+	if t.cl.config.DisablePEX {
+		return false
+	}
+	// BEP 27 forbids PEX for private torrents.
+	return !t.haveInfo() || t.info.Private == nil || !*t.info.Private
+}
+
+func pexKey(cp util.CompactPeer) string {
+	return net.JoinHostPort(cp.IP.String(), strconv.FormatInt(int64(cp.Port), 10))
+}
+
+// Sends each connection that supports PEX the changes to our peers since it
+// was last told.
+func (t *Torrent) sendPEX() {
+	if !t.pexAllowed() {
+		return
+	}
+	current := make(map[string]pexPeer, len(t.conns))
+	for _, c := range t.conns {
+		if addr, ok := c.pexAddr(); ok {
+			current[pexKey(addr)] = pexPeer{addr, c.pexFlags()}
+		}
+	}
+	for _, c := range t.conns {
+		id := c.PeerExtensionIDs["ut_pex"]
+		if id == 0 || c.webSeed != nil || c.closed.IsSet() {
+			continue
+		}
+		var self string
+		if addr, ok := c.pexAddr(); ok {
+			self = pexKey(addr)
+		}
+		msg, ok := c.pex.nextMessage(current, self)
+		if !ok {
+			continue
+		}
+		b, err := bencode.Marshal(msg)
+		if err != nil {
+			panic(err)
+		}
+		c.Post(pp.Message{
+			Type:            pp.Extended,
+			ExtendedID:      id,
+			ExtendedPayload: b,
+		})
+	}
+}
+
+// Returns the message that brings the connection up to date with the current
+// peers, excluding itself. Each list is limited to pexMaxPeers, and the rest
+// is left for later messages. ok is false if there's nothing to send.
+func (s *pexConnState) nextMessage(current map[string]pexPeer, self string) (msg peerExchangeMessage, ok bool) {
+	if s.sent == nil {
+		s.sent = make(map[string]util.CompactPeer)
+	}
+	for k, p := range current {
+		if _, ok := s.sent[k]; ok || k == self {
+			continue
+		}
+		if p.addr.IP.To4() != nil {
+			if len(msg.Added) >= pexMaxPeers {
+				continue
+			}
+			msg.Added = append(msg.Added, p.addr)
+			msg.AddedFlags = append(msg.AddedFlags, p.flags)
+		} else {
+			if len(msg.Added6) >= pexMaxPeers {
+				continue
+			}
+			msg.Added6 = append(msg.Added6, p.addr)
+			msg.Added6Flags = append(msg.Added6Flags, p.flags)
+		}
+		s.sent[k] = p.addr
+	}
+	for k, addr := range s.sent {
+		if _, ok := current[k]; ok && k != self {
+			continue
+		}
+		if addr.IP.To4() != nil {
+			if len(msg.Dropped) >= pexMaxPeers {
+				continue
+			}
+			msg.Dropped = append(msg.Dropped, addr)
+		} else {
+			if len(msg.Dropped6) >= pexMaxPeers {
+				continue
+			}
+			msg.Dropped6 = append(msg.Dropped6, addr)
+		}
+		delete(s.sent, k)
+	}
+	ok = len(msg.Added) != 0 || len(msg.Dropped) != 0 ||
+		len(msg.Added6) != 0 || len(msg.Dropped6) != 0
+	return
+}
+
+// The address other peers can reach the connection's peer at, if it's known.
+func (cn *connection) pexAddr() (ret util.CompactPeer, ok bool) {
+	if cn.webSeed != nil || cn.closed.IsSet() {
+		return
+	}
+	addr := cn.remoteAddr()
+	ret.IP = missinggo.AddrIP(addr)
+	if ip4 := ret.IP.To4(); ip4 != nil {
+		ret.IP = ip4
+	} else if cn.t.cl.config.DisableIPv6 {
+		return
+	}
+	if cn.Discovery == PeerSourceIncoming {
+		// The remote port is unlikely to be the one it listens on.
+		ret.Port = cn.PeerListenPort
+	} else {
+		ret.Port = missinggo.AddrPort(addr)
+	}
+	ok = ret.IP != nil && ret.Port != 0
+	return
+}
+
+func (cn *connection) pexFlags() (f byte) {
+	if cn.encrypted {
+		f |= pexPrefersEncryption
+	}
+	if cn.peerHasAll || cn.t.haveInfo() && cn.peerPieces.Len() == cn.t.numPieces() {
+		f |= pexSeedUploadOnly
+	}
+	if cn.uTP {
+		f |= pexSupportsUTP
+	}
+	if cn.Discovery != PeerSourceIncoming {
+		f |= pexOutgoingConn
+	}
+	return
 }
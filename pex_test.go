@@ -1,11 +1,14 @@
 package torrent
 
 import (
+	"net"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/lovedboy/torrent/bencode"
+	"github.com/lovedboy/torrent/util"
 )
 
 func TestUnmarshalPex(t *testing.T) {
@@ -16,3 +19,65 @@ func TestUnmarshalPex(t *testing.T) {
 	require.EqualValues(t, 1286, pem.Added[0].Port)
 	require.EqualValues(t, 0x100*0xb+0xc, pem.Added[1].Port)
 }
+
+func TestMarshalPex(t *testing.T) {
+	b, err := bencode.Marshal(peerExchangeMessage{
+		Added:      util.CompactIPv4Peers{{IP: net.IPv4(1, 2, 3, 4), Port: 0x506}},
+		AddedFlags: []byte{pexPrefersEncryption},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, "d5:added6:\x01\x02\x03\x04\x05\x067:added.f1:\x017:dropped0:e", string(b))
+}
+
+func TestPexNextMessage(t *testing.T) {
+	current := make(map[string]pexPeer)
+	for i := 0; i < pexMaxPeers+2; i++ {
+		cp := util.CompactPeer{IP: net.IPv4(1, 2, 3, byte(i)).To4(), Port: 1}
+		current[pexKey(cp)] = pexPeer{cp, pexSupportsUTP}
+	}
+	self := pexKey(util.CompactPeer{IP: net.IPv4(1, 2, 3, 0).To4(), Port: 1})
+	var s pexConnState
+	msg, ok := s.nextMessage(current, self)
+	require.True(t, ok)
+	assert.Len(t, msg.Added, pexMaxPeers)
+	assert.Len(t, msg.AddedFlags, pexMaxPeers)
+	assert.EqualValues(t, pexSupportsUTP, msg.AddedFlags[0])
+	assert.Empty(t, msg.Dropped)
+	// The remainder, less the connection's own address.
+	msg, ok = s.nextMessage(current, self)
+	require.True(t, ok)
+	assert.Len(t, msg.Added, 1)
+	_, ok = s.nextMessage(current, self)
+	assert.False(t, ok)
+	for k := range current {
+		if k != self {
+			delete(current, k)
+			break
+		}
+	}
+	msg, ok = s.nextMessage(current, self)
+	require.True(t, ok)
+	assert.Empty(t, msg.Added)
+	assert.Len(t, msg.Dropped, 1)
+}
+
+func TestPexIPv6(t *testing.T) {
+	var pem peerExchangeMessage
+	err := bencode.Unmarshal([]byte("d6:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe18:added6.f1:\x01e"), &pem)
+	require.NoError(t, err)
+	ps := pem.addedPeers()
+	require.Len(t, ps, 1)
+	assert.Equal(t, "[2001:db8::1]:6881", ps[0].String())
+	assert.True(t, ps[0].SupportsEncryption)
+	assert.Equal(t, PeerSourcePEX, ps[0].Source)
+	var s pexConnState
+	cp := util.CompactPeer{IP: net.ParseIP("2001:db8::1"), Port: 6881}
+	msg, ok := s.nextMessage(map[string]pexPeer{pexKey(cp): {cp, 0}}, "")
+	require.True(t, ok)
+	assert.Empty(t, msg.Added)
+	assert.Len(t, msg.Added6, 1)
+	b, err := bencode.Marshal(msg)
+	require.NoError(t, err)
+	require.NoError(t, bencode.Unmarshal(b, &pem))
+	assert.Equal(t, "2001:db8::1", pem.Added6[0].IP.String())
+}
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A byte rate limit that can be changed while it's in use. It's a token
+// bucket holding up to a second's worth of bytes. The zero value is
+// unlimited.
+type rateLimit struct {
+	mu      sync.Mutex
+	rate    int64 // Bytes per second, or 0 if unlimited.
+	tokens  float64
+	updated time.Time
+	// Closed and replaced when the rate changes, so waiters reconsider.
+	changed chan struct{}
+}
+
+// Sets the limit in bytes per second. Up to a second's worth of bytes can
+// accumulate for bursts. Zero or less removes the limit. Callers blocked
+// waiting on the limit are held to the new rate.
+func (rl *rateLimit) SetRate(bytesPerSecond int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	now := time.Now()
+	if rl.rate == 0 {
+		// Start full, as though we'd been idle.
+		rl.tokens = float64(bytesPerSecond)
+	} else {
+		rl.refill(now)
+		rl.tokens = math.Min(rl.tokens, float64(bytesPerSecond))
+	}
+	rl.rate = bytesPerSecond
+	rl.updated = now
+	if rl.changed != nil {
+		close(rl.changed)
+		rl.changed = nil
+	}
+}
+
+// Returns the limit in bytes per second, or 0 if there's no limit.
+func (rl *rateLimit) Rate() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate
+}
+
+func (rl *rateLimit) refill(now time.Time) {
+	rl.tokens = math.Min(float64(rl.rate), rl.tokens+now.Sub(rl.updated).Seconds()*float64(rl.rate))
+	rl.updated = now
+}
+
+// Blocks until n bytes are allowed through. Amounts larger than the burst are
+// let through a burst at a time.
+func (rl *rateLimit) wait(n int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for n > 0 && rl.rate != 0 {
+		rl.refill(time.Now())
+		take := float64(n)
+		if burst := float64(rl.rate); take > burst {
+			take = burst
+		}
+		if rl.tokens >= take {
+			rl.tokens -= take
+			n -= int64(take)
+			continue
+		}
+		d := time.Duration((take - rl.tokens) / float64(rl.rate) * float64(time.Second))
+		if rl.changed == nil {
+			rl.changed = make(chan struct{})
+		}
+		changed := rl.changed
+		rl.mu.Unlock()
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+		rl.mu.Lock()
+	}
+}
+
+// Blocks until n bytes are allowed through all the given limits.
+func waitRateLimits(n int64, limits ...*rateLimit) {
+	for _, l := range limits {
+		l.wait(n)
+	}
+}
@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitSetRate(t *testing.T) {
+	var l rateLimit
+	assert.EqualValues(t, 0, l.Rate())
+	// Unlimited never blocks.
+	l.wait(1 << 30)
+	l.SetRate(1000)
+	assert.EqualValues(t, 1000, l.Rate())
+	l.SetRate(0)
+	assert.EqualValues(t, 0, l.Rate())
+}
+
+func TestWaitRateLimits(t *testing.T) {
+	var a, b rateLimit
+	a.SetRate(1 << 20)
+	b.SetRate(100)
+	started := time.Now()
+	// The bucket starts full, so the first second's worth passes at once.
+	waitRateLimits(100, &a, &b)
+	waitRateLimits(10, &a, &b)
+	assert.True(t, time.Since(started) >= 50*time.Millisecond)
+}
+
+// Callers already blocked are held to changes in the rate.
+func TestRateLimitChangeWhileBlocked(t *testing.T) {
+	var l rateLimit
+	l.SetRate(100000)
+	l.wait(100000)
+	done := make(chan struct{})
+	go func() {
+		// Takes 100ms at the initial rate.
+		l.wait(10000)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.SetRate(100)
+	select {
+	case <-done:
+		t.Fatal("wait ignored the lowered rate")
+	case <-time.After(300 * time.Millisecond):
+	}
+	l.SetRate(1 << 20)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait ignored the raised rate")
+	}
+}
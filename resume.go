@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"errors"
+	"net"
+
+	"github.com/anacrolix/missinggo"
+
+	"github.com/lovedboy/torrent/metainfo"
+	pp "github.com/lovedboy/torrent/peer_protocol"
+)
+
+// State of a Torrent that can be saved, and given back in a TorrentSpec to
+// resume the torrent without redownloading chunks of incomplete pieces. It
+// can be bencoded.
+type ResumeData struct {
+	InfoHash metainfo.Hash `bencode:"info hash"`
+	// Dirty chunk indices are only meaningful for this chunk size.
+	ChunkSize int           `bencode:"chunk size"`
+	Pieces    []ResumePiece `bencode:"pieces,omitempty"`
+	// Pieces that were requested for download.
+	PendingPieces []int `bencode:"pending pieces,omitempty"`
+	// Files that have had their priority set.
+	Files []ResumeFile `bencode:"files,omitempty"`
+	Peers []ResumePeer `bencode:"peers,omitempty"`
+	// The tiered tracker URLs as known to the torrent.
+	Trackers [][]string `bencode:"trackers,omitempty"`
+	// Traffic over all sessions.
+	Stats ConnStats `bencode:"stats"`
+}
+
+// An incomplete piece that has some chunks written.
+type ResumePiece struct {
+	Index       int   `bencode:"index"`
+	DirtyChunks []int `bencode:"dirty chunks"`
+}
+
+type ResumeFile struct {
+	Index    int          `bencode:"index"`
+	Priority FilePriority `bencode:"priority"`
+}
+
+type ResumePeer struct {
+	IP                 string `bencode:"ip"`
+	Port               int    `bencode:"port"`
+	Source             byte   `bencode:"source,omitempty"`
+	SupportsEncryption bool   `bencode:"encryption,omitempty"`
+}
+
+// Returns the state needed to resume the torrent later, see ResumeData. It
+// remains valid after the torrent is dropped.
+func (t *Torrent) ResumeData() ResumeData {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	return t.resumeData()
+}
+
+func (t *Torrent) resumeData() (ret ResumeData) {
+	ret.InfoHash = t.infoHash
+	ret.ChunkSize = int(t.chunkSize)
+	ret.Stats = t.statsSnapshot().AllTime
+	for _, tier := range t.announceList() {
+		ret.Trackers = append(ret.Trackers, append([]string(nil), tier...))
+	}
+	for _, p := range t.peers {
+		ret.Peers = append(ret.Peers, resumePeer(p))
+	}
+	for _, c := range t.conns {
+		if c.Discovery == PeerSourceIncoming || c.webSeed != nil {
+			// The remote port isn't necessarily the one they listen on, and
+			// web seeds are restored from the metainfo.
+			continue
+		}
+		ret.Peers = append(ret.Peers, ResumePeer{
+			IP:                 missinggo.AddrIP(c.remoteAddr()).String(),
+			Port:               missinggo.AddrPort(c.remoteAddr()),
+			Source:             byte(c.Discovery),
+			SupportsEncryption: c.encrypted,
+		})
+	}
+	if t.resume != nil {
+		// We never got the info, so preserve whatever we were resumed with.
+		ret.Pieces = t.resume.Pieces
+		ret.PendingPieces = t.resume.PendingPieces
+		ret.Files = t.resume.Files
+		return
+	}
+	if !t.haveInfo() {
+		return
+	}
+	for i := range t.info.UpvertedFiles() {
+		if prio, ok := t.filePriorities[i]; ok {
+			ret.Files = append(ret.Files, ResumeFile{i, prio})
+		}
+	}
+	t.pendingPieces.IterTyped(func(piece int) bool {
+		ret.PendingPieces = append(ret.PendingPieces, piece)
+		return true
+	})
+	for i := range t.pieces {
+		p := &t.pieces[i]
+		if t.pieceComplete(i) || !p.hasDirtyChunks() {
+			continue
+		}
+		ret.Pieces = append(ret.Pieces, ResumePiece{
+			Index:       i,
+			DirtyChunks: p.DirtyChunks.ToSortedSlice(),
+		})
+	}
+	return
+}
+
+func resumePeer(p Peer) ResumePeer {
+	return ResumePeer{
+		IP:                 p.IP.String(),
+		Port:               p.Port,
+		Source:             byte(p.Source),
+		SupportsEncryption: p.SupportsEncryption,
+	}
+}
+
+// Applies resume data to a torrent. Anything that requires the info is
+// deferred until it's available.
+func (t *Torrent) setResumeData(rd *ResumeData) error {
+	if rd.InfoHash != t.infoHash {
+		return errors.New("resume data is for another torrent")
+	}
+	t.addTrackers(rd.Trackers)
+	var peers []Peer
+	for _, rp := range rd.Peers {
+		ip := net.ParseIP(rp.IP)
+		if ip == nil {
+			continue
+		}
+		peers = append(peers, Peer{
+			IP:                 ip,
+			Port:               rp.Port,
+			Source:             PeerSource(rp.Source),
+			SupportsEncryption: rp.SupportsEncryption,
+		})
+	}
+	t.cl.addPeers(t, peers)
+	t.prevSessionsStats = rd.Stats
+	t.resume = rd
+	if t.haveInfo() {
+		t.applyResumePieces()
+	}
+	return nil
+}
+
+// Restores dirty chunks and pending pieces from resume data, once the info is
+// known.
+func (t *Torrent) applyResumePieces() {
+	rd := t.resume
+	t.resume = nil
+	if rd == nil {
+		return
+	}
+	if pp.Integer(rd.ChunkSize) == t.chunkSize {
+		for _, rp := range rd.Pieces {
+			if rp.Index < 0 || rp.Index >= t.numPieces() || t.pieceComplete(rp.Index) {
+				continue
+			}
+			p := &t.pieces[rp.Index]
+			for _, ci := range rp.DirtyChunks {
+				if ci >= 0 && ci < p.numChunks() {
+					p.unpendChunkIndex(ci)
+				}
+			}
+			if t.pieceAllDirty(rp.Index) {
+				t.cl.queuePieceCheck(t, rp.Index)
+			}
+			t.publishPieceChange(rp.Index)
+		}
+	}
+	for _, piece := range rd.PendingPieces {
+		if piece >= 0 && piece < t.numPieces() {
+			t.pendPiece(piece)
+		}
+	}
+	numFiles := len(t.info.UpvertedFiles())
+	for _, rf := range rd.Files {
+		if rf.Index >= 0 && rf.Index < numFiles {
+			t.setFilePriority(rf.Index, rf.Priority)
+		}
+	}
+}
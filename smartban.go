@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io"
+	"net"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+// Published when a peer IP is banned for sending data that caused a piece to
+// fail its hash check.
+type PeerBan struct {
+	IP       net.IP
+	InfoHash metainfo.Hash
+	Piece    int
+}
+
+// Remembers hashes of the chunks each peer sent for incomplete pieces. When a
+// piece that failed its hash check later passes, the chunks it ended up with
+// are compared to those recorded, and only the peers that sent something
+// different are at fault.
+type smartBan struct {
+	pieces map[int]*smartBanPiece
+}
+
+type smartBanPiece struct {
+	// The piece has failed a hash check since records began.
+	failed bool
+	// Chunk index -> peer IP -> distinct hashes of what the peer sent.
+	chunks map[int]map[string][]metainfo.Hash
+}
+
+func chunkHash(b []byte) metainfo.Hash {
+	return sha1.Sum(b)
+}
+
+// Records that a peer sent the given data for a chunk.
+func (sb *smartBan) record(piece, chunk int, ip net.IP, data []byte) {
+	if sb.pieces == nil {
+		sb.pieces = make(map[int]*smartBanPiece)
+	}
+	p := sb.pieces[piece]
+	if p == nil {
+		p = &smartBanPiece{chunks: make(map[int]map[string][]metainfo.Hash)}
+		sb.pieces[piece] = p
+	}
+	peers := p.chunks[chunk]
+	if peers == nil {
+		peers = make(map[string][]metainfo.Hash)
+		p.chunks[chunk] = peers
+	}
+	h := chunkHash(data)
+	key := ip.String()
+	for _, other := range peers[key] {
+		if other == h {
+			return
+		}
+	}
+	peers[key] = append(peers[key], h)
+}
+
+// Whether chunk hashes are wanted when the piece is next hashed.
+func (sb *smartBan) wantChunkHashes(piece int) bool {
+	p := sb.pieces[piece]
+	return p != nil && p.failed
+}
+
+// Notes a failed hash check for the piece. If a single peer sent every chunk
+// of it, that peer must be at fault and it's returned.
+func (sb *smartBan) pieceFailed(piece, numChunks int) (culprits []net.IP) {
+	p := sb.pieces[piece]
+	if p == nil {
+		return
+	}
+	p.failed = true
+	if len(p.chunks) < numChunks {
+		// Some of the data came from elsewhere.
+		return
+	}
+	ips := p.peerIPs()
+	if len(ips) == 1 {
+		culprits = ips
+	}
+	return
+}
+
+// Notes that the piece passed its hash check with the given chunk hashes,
+// returning the peers that sent something else. The records for the piece are
+// discarded.
+func (sb *smartBan) piecePassed(piece int, chunkHashes []metainfo.Hash) (culprits []net.IP) {
+	p := sb.pieces[piece]
+	delete(sb.pieces, piece)
+	if p == nil || !p.failed || chunkHashes == nil {
+		return
+	}
+	bad := make(map[string]struct{})
+	for chunk, peers := range p.chunks {
+		if chunk >= len(chunkHashes) {
+			continue
+		}
+		for ip, hashes := range peers {
+			for _, h := range hashes {
+				if h != chunkHashes[chunk] {
+					bad[ip] = struct{}{}
+				}
+			}
+		}
+	}
+	for ip := range bad {
+		culprits = append(culprits, net.ParseIP(ip))
+	}
+	return
+}
+
+func (p *smartBanPiece) peerIPs() (ret []net.IP) {
+	seen := make(map[string]struct{})
+	for _, peers := range p.chunks {
+		for ip := range peers {
+			if _, ok := seen[ip]; ok {
+				continue
+			}
+			seen[ip] = struct{}{}
+			ret = append(ret, net.ParseIP(ip))
+		}
+	}
+	return
+}
+
+// Copies length bytes from r to w, returning the hashes of each chunk read
+// along the way.
+func copyHashingChunks(w io.Writer, r io.Reader, length, chunkSize int64) (n int64, chunks []metainfo.Hash, err error) {
+	b := make([]byte, chunkSize)
+	for n < length {
+		if length-n < chunkSize {
+			b = b[:length-n]
+		}
+		var m int
+		m, err = io.ReadFull(r, b)
+		w.Write(b[:m])
+		n += int64(m)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		chunks = append(chunks, chunkHash(b))
+	}
+	return
+}
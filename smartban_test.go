@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func TestSmartBanSinglePeerFailure(t *testing.T) {
+	var sb smartBan
+	ip := net.ParseIP("1.2.3.4")
+	sb.record(0, 0, ip, []byte("a"))
+	// Not all the chunks came from the peer.
+	assert.Empty(t, sb.pieceFailed(0, 2))
+	sb.record(0, 1, ip, []byte("b"))
+	culprits := sb.pieceFailed(0, 2)
+	require.Len(t, culprits, 1)
+	assert.True(t, culprits[0].Equal(ip))
+}
+
+func TestSmartBanBlamesOnlyBadChunks(t *testing.T) {
+	var sb smartBan
+	good := net.ParseIP("1.2.3.4")
+	bad := net.ParseIP("5.6.7.8")
+	sb.record(0, 0, good, []byte("a"))
+	sb.record(0, 1, bad, []byte("x"))
+	assert.False(t, sb.wantChunkHashes(0))
+	assert.Empty(t, sb.pieceFailed(0, 2))
+	assert.True(t, sb.wantChunkHashes(0))
+	// The piece is fetched again, this time entirely from the good peer.
+	sb.record(0, 0, good, []byte("a"))
+	sb.record(0, 1, good, []byte("b"))
+	culprits := sb.piecePassed(0, []metainfo.Hash{chunkHash([]byte("a")), chunkHash([]byte("b"))})
+	require.Len(t, culprits, 1)
+	assert.True(t, culprits[0].Equal(bad))
+	// The records are gone.
+	assert.False(t, sb.wantChunkHashes(0))
+	assert.Empty(t, sb.piecePassed(0, nil))
+}
+
+func TestSmartBanPassFirstTime(t *testing.T) {
+	var sb smartBan
+	sb.record(1, 0, net.ParseIP("1.2.3.4"), []byte("a"))
+	assert.Empty(t, sb.piecePassed(1, nil))
+	assert.Empty(t, sb.pieces)
+}
+
+func TestCopyHashingChunks(t *testing.T) {
+	data := []byte("hello, world")
+	var buf bytes.Buffer
+	n, chunks, err := copyHashingChunks(&buf, bytes.NewReader(data), int64(len(data)), 5)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+	require.Len(t, chunks, 3)
+	assert.EqualValues(t, sha1.Sum([]byte("hello")), chunks[0])
+	assert.EqualValues(t, sha1.Sum([]byte("ld")), chunks[2])
+	_, _, err = copyHashingChunks(ioutil.Discard, bytes.NewReader(data), 20, 5)
+	assert.Error(t, err)
+}
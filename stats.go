@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"io"
+	"time"
+
+	pp "github.com/lovedboy/torrent/peer_protocol"
+)
+
+// Counts of traffic exchanged with peers. The Data fields count only piece
+// payload, while the others include all the bytes on the wire, including
+// protocol overhead.
+type ConnStats struct {
+	BytesWritten     int64 `bencode:"bytes written"`
+	BytesWrittenData int64 `bencode:"bytes written data"`
+	BytesRead        int64 `bencode:"bytes read"`
+	BytesReadData    int64 `bencode:"bytes read data"`
+	ChunksWritten    int64 `bencode:"chunks written"`
+	ChunksRead       int64 `bencode:"chunks read"`
+}
+
+func (cs *ConnStats) Add(other ConnStats) {
+	cs.BytesWritten += other.BytesWritten
+	cs.BytesWrittenData += other.BytesWrittenData
+	cs.BytesRead += other.BytesRead
+	cs.BytesReadData += other.BytesReadData
+	cs.ChunksWritten += other.ChunksWritten
+	cs.ChunksRead += other.ChunksRead
+}
+
+func (cs *ConnStats) wroteMsg(msg *pp.Message, n int) {
+	cs.BytesWritten += int64(n)
+	if !msg.Keepalive && msg.Type == pp.Piece {
+		cs.ChunksWritten++
+		cs.BytesWrittenData += int64(len(msg.Piece))
+	}
+}
+
+func (cs *ConnStats) readMsg(msg *pp.Message) {
+	if !msg.Keepalive && msg.Type == pp.Piece {
+		cs.ChunksRead++
+		cs.BytesReadData += int64(len(msg.Piece))
+	}
+}
+
+func (cs *ConnStats) readBytes(n int64) {
+	cs.BytesRead += n
+}
+
+// A snapshot of a Torrent's traffic.
+type TorrentStats struct {
+	// Traffic since the torrent was added to the Client.
+	Session ConnStats
+	// Session traffic, plus that from previous sessions carried over in
+	// resume data.
+	AllTime ConnStats
+	// Recent payload rates in bytes per second.
+	DownloadRate float64
+	UploadRate   float64
+	ActivePeers  int
+	// The active peers that are connected over IPv6.
+	ActivePeersIPv6 int
+}
+
+// A moving average of the rate of a growing count. It's updated at regular
+// intervals with the latest total.
+type rollingRate struct {
+	last int64
+	rate float64
+}
+
+func (r *rollingRate) update(total int64, interval time.Duration) {
+	r.rate = (r.rate + float64(total-r.last)/interval.Seconds()) / 2
+	r.last = total
+}
+
+// Per second.
+func (r *rollingRate) Rate() float64 {
+	return r.rate
+}
+
+// Counts bytes passing through a Reader. It's not safe for concurrent use.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (me *countingReader) Read(b []byte) (n int, err error) {
+	n, err = me.r.Read(b)
+	me.n += int64(n)
+	return
+}
@@ -0,0 +1,42 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	pp "github.com/lovedboy/torrent/peer_protocol"
+)
+
+func TestConnStatsMessages(t *testing.T) {
+	var cs ConnStats
+	cs.wroteMsg(&pp.Message{Keepalive: true}, 4)
+	cs.wroteMsg(&pp.Message{Type: pp.Piece, Piece: make([]byte, 10)}, 23)
+	cs.readBytes(17)
+	cs.readMsg(&pp.Message{Type: pp.Piece, Piece: make([]byte, 4)})
+	cs.readMsg(&pp.Message{Type: pp.Have})
+	assert.EqualValues(t, ConnStats{
+		BytesWritten:     27,
+		BytesWrittenData: 10,
+		BytesRead:        17,
+		BytesReadData:    4,
+		ChunksWritten:    1,
+		ChunksRead:       1,
+	}, cs)
+	var total ConnStats
+	total.Add(cs)
+	total.Add(cs)
+	assert.EqualValues(t, 54, total.BytesWritten)
+	assert.EqualValues(t, 2, total.ChunksRead)
+}
+
+func TestRollingRate(t *testing.T) {
+	var r rollingRate
+	r.update(100, time.Second)
+	assert.EqualValues(t, 50, r.Rate())
+	r.update(200, time.Second)
+	assert.EqualValues(t, 75, r.Rate())
+	r.update(200, time.Second)
+	assert.EqualValues(t, 37.5, r.Rate())
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"log"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+// Records which pieces have been completed, keyed by infohash and piece
+// index. Implementations that persist this allow storage to skip rehashing
+// data that was already verified in a previous session. Storage given a
+// PieceCompletion by its creator doesn't close it.
+type PieceCompletion interface {
+	Get(metainfo.PieceKey) (bool, error)
+	Set(metainfo.PieceKey, bool) error
+	// Forgets the completion of all pieces.
+	Clear() error
+	Close() error
+}
+
+// Returns the default completion store for storage rooted at dir. Falls back
+// to an in-memory store if a persistent one can't be opened there.
+func pieceCompletionForDir(dir string) (ret PieceCompletion) {
+	ret, err := NewBoltPieceCompletion(dir)
+	if err != nil {
+		log.Printf("couldn't open piece completion db in %q: %s", dir, err)
+		ret = NewMapPieceCompletion()
+	}
+	return
+}
+
+// Returns the stored completion of the piece. Errors are logged and treated
+// as incomplete, so the piece is hashed again.
+func getPieceCompletion(pc PieceCompletion, pk metainfo.PieceKey) bool {
+	ret, err := pc.Get(pk)
+	if err != nil {
+		log.Printf("error getting piece completion: %s", err)
+	}
+	return ret
+}
+
+// Implemented by storage that records completion in a PieceCompletion.
+type completionStorage interface {
+	pieceCompletion() PieceCompletion
+}
+
+// Forgets the piece completion recorded by the storage, so that pieces are
+// hashed again. Returns true if anything was cleared.
+func ClearComplete(v interface{}) bool {
+	cs, ok := v.(completionStorage)
+	if !ok {
+		return false
+	}
+	pc := cs.pieceCompletion()
+	if pc == nil {
+		return false
+	}
+	if err := pc.Clear(); err != nil {
+		log.Printf("error clearing piece completion: %s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+var (
+	completedValue      = []byte{1}
+	completionBucketKey = []byte("completion")
+)
+
+// Stores piece completion in a bolt database. Each torrent gets a bucket
+// named by its infohash, with piece indices as keys.
+type boltPieceCompletion struct {
+	db *bolt.DB
+}
+
+func NewBoltPieceCompletion(dir string) (PieceCompletion, error) {
+	db, err := bolt.Open(filepath.Join(dir, ".torrent.bolt.db"), 0660, &bolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	return &boltPieceCompletion{db}, nil
+}
+
+func boltPieceKey(pk metainfo.PieceKey) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(pk.Index))
+	return key[:]
+}
+
+func (me *boltPieceCompletion) Get(pk metainfo.PieceKey) (ret bool, err error) {
+	err = me.db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket(completionBucketKey)
+		if cb == nil {
+			return nil
+		}
+		ih := cb.Bucket(pk.InfoHash[:])
+		if ih == nil {
+			return nil
+		}
+		ret = ih.Get(boltPieceKey(pk)) != nil
+		return nil
+	})
+	return
+}
+
+func (me *boltPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
+	return me.db.Update(func(tx *bolt.Tx) error {
+		c, err := tx.CreateBucketIfNotExists(completionBucketKey)
+		if err != nil {
+			return err
+		}
+		ih, err := c.CreateBucketIfNotExists(pk.InfoHash[:])
+		if err != nil {
+			return err
+		}
+		if b {
+			return ih.Put(boltPieceKey(pk), completedValue)
+		}
+		return ih.Delete(boltPieceKey(pk))
+	})
+}
+
+func (me *boltPieceCompletion) Clear() error {
+	return me.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(completionBucketKey)
+		if err == bolt.ErrBucketNotFound {
+			err = nil
+		}
+		return err
+	})
+}
+
+func (me *boltPieceCompletion) Close() error {
+	return me.db.Close()
+}
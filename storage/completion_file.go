@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+// Stores piece completion in flat files, one per torrent, named by the hex
+// infohash. Each file is a bitfield with the high bit of the first byte
+// corresponding to piece 0.
+type filePieceCompletion struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewFilePieceCompletion(dir string) (PieceCompletion, error) {
+	err := os.MkdirAll(dir, 0770)
+	if err != nil {
+		return nil, err
+	}
+	return &filePieceCompletion{dir: dir}, nil
+}
+
+func (me *filePieceCompletion) path(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, ih.HexString()+".completion")
+}
+
+func (me *filePieceCompletion) Get(pk metainfo.PieceKey) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	f, err := os.Open(me.path(pk.InfoHash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var b [1]byte
+	_, err = f.ReadAt(b[:], int64(pk.Index/8))
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return b[0]&(0x80>>uint(pk.Index%8)) != 0, nil
+}
+
+func (me *filePieceCompletion) Set(pk metainfo.PieceKey, complete bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	f, err := os.OpenFile(me.path(pk.InfoHash), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	off := int64(pk.Index / 8)
+	var b [1]byte
+	_, err = f.ReadAt(b[:], off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	mask := byte(0x80 >> uint(pk.Index%8))
+	if complete {
+		b[0] |= mask
+	} else {
+		b[0] &^= mask
+	}
+	_, err = f.WriteAt(b[:], off)
+	return err
+}
+
+func (me *filePieceCompletion) Clear() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(me.dir, "*.completion"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *filePieceCompletion) Close() error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+// Keeps piece completion in memory. Nothing survives the process.
+type mapPieceCompletion struct {
+	mu sync.Mutex
+	m  map[metainfo.PieceKey]struct{}
+}
+
+func NewMapPieceCompletion() PieceCompletion {
+	return &mapPieceCompletion{}
+}
+
+func (me *mapPieceCompletion) Get(pk metainfo.PieceKey) (bool, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	_, ok := me.m[pk]
+	return ok, nil
+}
+
+func (me *mapPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if b {
+		if me.m == nil {
+			me.m = make(map[metainfo.PieceKey]struct{})
+		}
+		me.m[pk] = struct{}{}
+	} else {
+		delete(me.m, pk)
+	}
+	return nil
+}
+
+func (me *mapPieceCompletion) Clear() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.m = nil
+	return nil
+}
+
+func (me *mapPieceCompletion) Close() error {
+	return nil
+}
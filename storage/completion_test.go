@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anacrolix/missinggo/filecache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func testPieceCompletion(t *testing.T, pc PieceCompletion) {
+	defer pc.Close()
+	pk := metainfo.PieceKey{metainfo.Hash{1}, 9}
+	b, err := pc.Get(pk)
+	require.NoError(t, err)
+	assert.False(t, b)
+	require.NoError(t, pc.Set(pk, true))
+	b, err = pc.Get(pk)
+	require.NoError(t, err)
+	assert.True(t, b)
+	// Neighbouring pieces and other torrents are unaffected.
+	b, err = pc.Get(metainfo.PieceKey{metainfo.Hash{1}, 8})
+	require.NoError(t, err)
+	assert.False(t, b)
+	b, err = pc.Get(metainfo.PieceKey{metainfo.Hash{2}, 9})
+	require.NoError(t, err)
+	assert.False(t, b)
+	require.NoError(t, pc.Set(pk, false))
+	b, err = pc.Get(pk)
+	require.NoError(t, err)
+	assert.False(t, b)
+	require.NoError(t, pc.Set(pk, true))
+	require.NoError(t, pc.Clear())
+	b, err = pc.Get(pk)
+	require.NoError(t, err)
+	assert.False(t, b)
+	// Clearing an empty store is fine.
+	require.NoError(t, pc.Clear())
+}
+
+func TestMapPieceCompletion(t *testing.T) {
+	testPieceCompletion(t, NewMapPieceCompletion())
+}
+
+func TestFilePieceCompletion(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	pc, err := NewFilePieceCompletion(td)
+	require.NoError(t, err)
+	testPieceCompletion(t, pc)
+}
+
+func TestBoltPieceCompletion(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	pc, err := NewBoltPieceCompletion(td)
+	require.NoError(t, err)
+	testPieceCompletion(t, pc)
+}
+
+func TestFileStorageCompletionPersists(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	info := &metainfo.InfoEx{
+		Info: metainfo.Info{
+			Name:        "a",
+			Length:      2,
+			PieceLength: 1,
+			Pieces:      make([]byte, 40),
+		},
+	}
+	pc, err := NewBoltPieceCompletion(td)
+	require.NoError(t, err)
+	ts, err := NewFileWithCompletion(td, pc).OpenTorrent(info)
+	require.NoError(t, err)
+	require.NoError(t, ts.Piece(info.Piece(1)).MarkComplete())
+	require.NoError(t, pc.Close())
+	// A new store over the same directory sees the earlier completion.
+	pc, err = NewBoltPieceCompletion(td)
+	require.NoError(t, err)
+	defer pc.Close()
+	ts, err = NewFileWithCompletion(td, pc).OpenTorrent(info)
+	require.NoError(t, err)
+	assert.False(t, ts.Piece(info.Piece(0)).GetIsComplete())
+	assert.True(t, ts.Piece(info.Piece(1)).GetIsComplete())
+}
+
+func TestClearComplete(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	info := &metainfo.InfoEx{
+		Info: metainfo.Info{
+			Name:        "a",
+			Length:      1,
+			PieceLength: 1,
+			Pieces:      make([]byte, 20),
+		},
+	}
+	// The defaults use a bolt database in td, so this one goes elsewhere.
+	bd, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(bd)
+	bpc, err := NewBoltPieceCompletion(bd)
+	require.NoError(t, err)
+	defer bpc.Close()
+	fpc, err := NewFilePieceCompletion(td)
+	require.NoError(t, err)
+	for _, newStorage := range []func() Client{
+		func() Client { return NewFile(td) },
+		func() Client { return NewMMap(td) },
+		func() Client { return NewFileWithCompletion(td, bpc) },
+		func() Client { return NewMMapWithCompletion(td, fpc) },
+	} {
+		s := newStorage()
+		ts, err := s.OpenTorrent(info)
+		require.NoError(t, err)
+		p := ts.Piece(info.Piece(0))
+		require.NoError(t, p.MarkComplete())
+		assert.True(t, p.GetIsComplete())
+		assert.True(t, ClearComplete(s))
+		assert.False(t, p.GetIsComplete())
+		ts.Close()
+		require.NoError(t, s.(io.Closer).Close())
+	}
+	assert.False(t, ClearComplete(nil))
+}
+
+// The default completion store outlives the storage, so data needn't be
+// hashed again after a restart.
+func TestDefaultCompletionPersists(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	info := &metainfo.InfoEx{
+		Info: metainfo.Info{
+			Name:        "a",
+			Length:      1,
+			PieceLength: 1,
+			Pieces:      make([]byte, 20),
+		},
+	}
+	for _, newStorage := range []func(string) Client{NewFile, NewMMap} {
+		s := newStorage(td)
+		ts, err := s.OpenTorrent(info)
+		require.NoError(t, err)
+		require.NoError(t, ts.Piece(info.Piece(0)).MarkComplete())
+		ts.Close()
+		require.NoError(t, s.(io.Closer).Close())
+		s = newStorage(td)
+		ts, err = s.OpenTorrent(info)
+		require.NoError(t, err)
+		assert.True(t, ts.Piece(info.Piece(0)).GetIsComplete())
+		assert.True(t, ClearComplete(s))
+		ts.Close()
+		require.NoError(t, s.(io.Closer).Close())
+	}
+}
+
+func TestFileStorePiecesCompletion(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	fc, err := filecache.NewCache(td)
+	require.NoError(t, err)
+	info := &metainfo.InfoEx{
+		Info: metainfo.Info{
+			Name:        "a",
+			Length:      1,
+			PieceLength: 1,
+			Pieces:      make([]byte, 20),
+		},
+	}
+	pc := NewMapPieceCompletion()
+	s := NewFileStorePiecesWithCompletion(fc.AsFileStore(), pc)
+	ts, err := s.OpenTorrent(info)
+	require.NoError(t, err)
+	p := ts.Piece(info.Piece(0))
+	_, err = p.WriteAt([]byte{1}, 0)
+	require.NoError(t, err)
+	assert.False(t, p.GetIsComplete())
+	require.NoError(t, p.MarkComplete())
+	assert.True(t, p.GetIsComplete())
+	// Cleared completion means the piece is hashed and marked again, though
+	// it's already in place.
+	assert.True(t, ClearComplete(s))
+	assert.False(t, p.GetIsComplete())
+	require.NoError(t, p.MarkComplete())
+	assert.True(t, p.GetIsComplete())
+	// Without a completion store, the file store alone decides.
+	s = NewFileStorePieces(fc.AsFileStore())
+	ts, err = s.OpenTorrent(info)
+	require.NoError(t, err)
+	assert.True(t, ts.Piece(info.Piece(0)).GetIsComplete())
+	assert.False(t, ClearComplete(s))
+}
@@ -13,34 +13,54 @@ import (
 // File-based storage for torrents, that isn't yet bound to a particular
 // torrent.
 type fileStorage struct {
-	baseDir   string
-	completed map[[20]byte]bool
+	baseDir    string
+	completion PieceCompletion
+	// The completion store was opened here, and is closed with the storage.
+	ownCompletion bool
 }
 
+// Piece completion is persisted in baseDir if possible, otherwise it's held
+// in memory. The returned Client is an io.Closer, that closes the completion
+// store.
 func NewFile(baseDir string) Client {
 	return &fileStorage{
-		baseDir: baseDir,
+		baseDir:       baseDir,
+		completion:    pieceCompletionForDir(baseDir),
+		ownCompletion: true,
 	}
 }
 
-func ClearComplete(v interface{}) bool {
-	if fs, ok := v.(*fileStorage); ok {
-		fs.completed = nil
-		return ok
+// Piece completion is recorded in the given store, which the caller must
+// close when it's done with the storage.
+func NewFileWithCompletion(baseDir string, completion PieceCompletion) Client {
+	return &fileStorage{
+		baseDir:    baseDir,
+		completion: completion,
+	}
+}
+
+func (fs *fileStorage) pieceCompletion() PieceCompletion {
+	return fs.completion
+}
+
+func (fs *fileStorage) Close() error {
+	if !fs.ownCompletion {
+		return nil
 	}
-	return false
+	return fs.completion.Close()
 }
 
 func (fs *fileStorage) OpenTorrent(info *metainfo.InfoEx) (Torrent, error) {
-	return fileTorrentStorage{fs}, nil
+	return fileTorrentStorage{fs, info.Hash()}, nil
 }
 
 // File-based torrent storage, not yet bound to a Torrent.
 type fileTorrentStorage struct {
 	*fileStorage
+	infoHash metainfo.Hash
 }
 
-func (fs *fileStorage) Piece(p metainfo.Piece) Piece {
+func (fs fileTorrentStorage) Piece(p metainfo.Piece) Piece {
 	// Create a view onto the file-based torrent storage.
 	_io := &fileStorageTorrent{
 		p.Info,
@@ -55,27 +75,27 @@ func (fs *fileStorage) Piece(p metainfo.Piece) Piece {
 	}
 }
 
-func (fs *fileStorage) Close() error {
+func (fs fileTorrentStorage) Close() error {
 	return nil
 }
 
 type fileStoragePiece struct {
-	*fileStorage
+	fileTorrentStorage
 	p metainfo.Piece
 	io.WriterAt
 	io.ReaderAt
 }
 
+func (fs *fileStoragePiece) pieceKey() metainfo.PieceKey {
+	return metainfo.PieceKey{fs.infoHash, fs.p.Index()}
+}
+
 func (fs *fileStoragePiece) GetIsComplete() bool {
-	return fs.completed[fs.p.Hash()]
+	return getPieceCompletion(fs.completion, fs.pieceKey())
 }
 
 func (fs *fileStoragePiece) MarkComplete() error {
-	if fs.completed == nil {
-		fs.completed = make(map[[20]byte]bool)
-	}
-	fs.completed[fs.p.Hash()] = true
-	return nil
+	return fs.completion.Set(fs.pieceKey(), true)
 }
 
 // Exposes file-based storage of a torrent, as one big ReadWriterAt.
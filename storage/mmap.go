@@ -14,26 +14,57 @@ import (
 )
 
 type mmapStorage struct {
-	baseDir string
+	baseDir    string
+	completion PieceCompletion
+	// The completion store was opened here, and is closed with the storage.
+	ownCompletion bool
 }
 
+// Piece completion is persisted in baseDir if possible, otherwise it's held
+// in memory. The returned Client is an io.Closer, that closes the completion
+// store.
 func NewMMap(baseDir string) Client {
 	return &mmapStorage{
-		baseDir: baseDir,
+		baseDir:       baseDir,
+		completion:    pieceCompletionForDir(baseDir),
+		ownCompletion: true,
 	}
 }
 
+// Piece completion is recorded in the given store, which the caller must
+// close when it's done with the storage.
+func NewMMapWithCompletion(baseDir string, completion PieceCompletion) Client {
+	return &mmapStorage{
+		baseDir:    baseDir,
+		completion: completion,
+	}
+}
+
+func (s *mmapStorage) pieceCompletion() PieceCompletion {
+	return s.completion
+}
+
+func (s *mmapStorage) Close() error {
+	if !s.ownCompletion {
+		return nil
+	}
+	return s.completion.Close()
+}
+
 func (s *mmapStorage) OpenTorrent(info *metainfo.InfoEx) (t Torrent, err error) {
 	span, err := MMapTorrent(&info.Info, s.baseDir)
 	t = &mmapTorrentStorage{
-		span: span,
+		span:       span,
+		infoHash:   info.Hash(),
+		completion: s.completion,
 	}
 	return
 }
 
 type mmapTorrentStorage struct {
-	span      mmap_span.MMapSpan
-	completed map[metainfo.Hash]bool
+	span       mmap_span.MMapSpan
+	infoHash   metainfo.Hash
+	completion PieceCompletion
 }
 
 func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) Piece {
@@ -57,16 +88,16 @@ type mmapStoragePiece struct {
 	io.WriterAt
 }
 
+func (sp mmapStoragePiece) pieceKey() metainfo.PieceKey {
+	return metainfo.PieceKey{sp.storage.infoHash, sp.p.Index()}
+}
+
 func (sp mmapStoragePiece) GetIsComplete() bool {
-	return sp.storage.completed[sp.p.Hash()]
+	return getPieceCompletion(sp.storage.completion, sp.pieceKey())
 }
 
 func (sp mmapStoragePiece) MarkComplete() error {
-	if sp.storage.completed == nil {
-		sp.storage.completed = make(map[metainfo.Hash]bool)
-	}
-	sp.storage.completed[sp.p.Hash()] = true
-	return nil
+	return sp.storage.completion.Set(sp.pieceKey(), true)
 }
 
 func MMapTorrent(md *metainfo.Info, location string) (mms mmap_span.MMapSpan, err error) {
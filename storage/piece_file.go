@@ -12,21 +12,37 @@ import (
 )
 
 type pieceFileStorage struct {
-	fs missinggo.FileStore
+	fs         missinggo.FileStore
+	completion PieceCompletion
 }
 
+// Completion is determined by the presence of completed pieces in the file
+// store alone.
 func NewFileStorePieces(fs missinggo.FileStore) Client {
+	return NewFileStorePiecesWithCompletion(fs, nil)
+}
+
+// Pieces are complete if they're recorded so in the completion store, and
+// the file store hasn't dropped them since. The caller must close the
+// completion store when it's done with the storage.
+func NewFileStorePiecesWithCompletion(fs missinggo.FileStore, completion PieceCompletion) Client {
 	return &pieceFileStorage{
-		fs: fs,
+		fs:         fs,
+		completion: completion,
 	}
 }
 
+func (s *pieceFileStorage) pieceCompletion() PieceCompletion {
+	return s.completion
+}
+
 type pieceFileTorrentStorage struct {
-	s *pieceFileStorage
+	s        *pieceFileStorage
+	infoHash metainfo.Hash
 }
 
 func (s *pieceFileStorage) OpenTorrent(info *metainfo.InfoEx) (Torrent, error) {
-	return &pieceFileTorrentStorage{s}, nil
+	return &pieceFileTorrentStorage{s, info.Hash()}, nil
 }
 
 func (s *pieceFileTorrentStorage) Close() error {
@@ -51,13 +67,37 @@ func (s pieceFileTorrentStoragePiece) incompletePath() string {
 	return path.Join("incomplete", s.p.Hash().HexString())
 }
 
-func (s pieceFileTorrentStoragePiece) GetIsComplete() bool {
+func (s pieceFileTorrentStoragePiece) pieceKey() metainfo.PieceKey {
+	return metainfo.PieceKey{s.ts.infoHash, s.p.Index()}
+}
+
+// Whether the file store holds the whole piece as completed.
+func (s pieceFileTorrentStoragePiece) completedPresent() bool {
 	fi, err := s.fs.Stat(s.completedPath())
 	return err == nil && fi.Size() == s.p.Length()
 }
 
+func (s pieceFileTorrentStoragePiece) GetIsComplete() bool {
+	if !s.completedPresent() {
+		return false
+	}
+	if s.ts.s.completion == nil {
+		return true
+	}
+	return getPieceCompletion(s.ts.s.completion, s.pieceKey())
+}
+
 func (s pieceFileTorrentStoragePiece) MarkComplete() error {
-	return s.fs.Rename(s.incompletePath(), s.completedPath())
+	err := s.fs.Rename(s.incompletePath(), s.completedPath())
+	// The piece may already be in place if its completion was cleared and
+	// it was hashed again.
+	if err != nil && !s.completedPresent() {
+		return err
+	}
+	if s.ts.s.completion == nil {
+		return nil
+	}
+	return s.ts.s.completion.Set(s.pieceKey(), true)
 }
 
 func (s pieceFileTorrentStoragePiece) openFile() (f missinggo.File, err error) {
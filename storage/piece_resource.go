@@ -11,24 +11,44 @@ import (
 )
 
 type piecePerResource struct {
-	p resource.Provider
+	p          resource.Provider
+	completion PieceCompletion
 }
 
+// Completion is determined by the presence of completed pieces in the
+// provider alone.
 func NewResourcePieces(p resource.Provider) Client {
+	return NewResourcePiecesWithCompletion(p, nil)
+}
+
+// Pieces are complete if they're recorded so in the completion store, and
+// their resources haven't been evicted since. The caller must close the
+// completion store when it's done with the storage.
+func NewResourcePiecesWithCompletion(p resource.Provider, completion PieceCompletion) Client {
 	return &piecePerResource{
-		p: p,
+		p:          p,
+		completion: completion,
 	}
 }
 
+func (s *piecePerResource) pieceCompletion() PieceCompletion {
+	return s.completion
+}
+
+type piecePerResourceTorrent struct {
+	*piecePerResource
+	infoHash metainfo.Hash
+}
+
 func (s *piecePerResource) OpenTorrent(info *metainfo.InfoEx) (Torrent, error) {
-	return s, nil
+	return piecePerResourceTorrent{s, info.Hash()}, nil
 }
 
-func (s *piecePerResource) Close() error {
+func (s piecePerResourceTorrent) Close() error {
 	return nil
 }
 
-func (s *piecePerResource) Piece(p metainfo.Piece) Piece {
+func (s piecePerResourceTorrent) Piece(p metainfo.Piece) Piece {
 	completed, err := s.p.NewInstance(path.Join("completed", p.Hash().HexString()))
 	if err != nil {
 		panic(err)
@@ -38,25 +58,49 @@ func (s *piecePerResource) Piece(p metainfo.Piece) Piece {
 		panic(err)
 	}
 	return piecePerResourcePiece{
-		p: p,
-		c: completed,
-		i: incomplete,
+		p:          p,
+		key:        metainfo.PieceKey{s.infoHash, p.Index()},
+		completion: s.completion,
+		c:          completed,
+		i:          incomplete,
 	}
 }
 
 type piecePerResourcePiece struct {
-	p metainfo.Piece
-	c resource.Instance
-	i resource.Instance
+	p          metainfo.Piece
+	key        metainfo.PieceKey
+	completion PieceCompletion
+	c          resource.Instance
+	i          resource.Instance
 }
 
-func (s piecePerResourcePiece) GetIsComplete() bool {
+// Whether the completed resource holds the whole piece.
+func (s piecePerResourcePiece) completedPresent() bool {
 	fi, err := s.c.Stat()
 	return err == nil && fi.Size() == s.p.Length()
 }
 
+func (s piecePerResourcePiece) GetIsComplete() bool {
+	if !s.completedPresent() {
+		return false
+	}
+	if s.completion == nil {
+		return true
+	}
+	return getPieceCompletion(s.completion, s.key)
+}
+
 func (s piecePerResourcePiece) MarkComplete() error {
-	return resource.Move(s.i, s.c)
+	err := resource.Move(s.i, s.c)
+	// The piece may already be in place if its completion was cleared and
+	// it was hashed again.
+	if err != nil && !s.completedPresent() {
+		return err
+	}
+	if s.completion == nil {
+		return nil
+	}
+	return s.completion.Set(s.key, true)
 }
 
 func (s piecePerResourcePiece) ReadAt(b []byte, off int64) (n int, err error) {
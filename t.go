@@ -69,6 +69,13 @@ func (t *Torrent) Drop() {
 	t.cl.mu.Unlock()
 }
 
+// Returns a snapshot of the torrent's traffic with peers.
+func (t *Torrent) Stats() TorrentStats {
+	t.cl.mu.RLock()
+	defer t.cl.mu.RUnlock()
+	return t.statsSnapshot()
+}
+
 // Number of bytes of the entire torrent we have completed.
 func (t *Torrent) BytesCompleted() int64 {
 	t.cl.mu.RLock()
@@ -165,6 +172,7 @@ func (t *Torrent) Files() (ret []File) {
 	for _, fi := range info.UpvertedFiles() {
 		ret = append(ret, File{
 			t,
+			len(ret),
 			strings.Join(append([]string{info.Name}, fi.Path...), "/"),
 			offset,
 			fi.Length,
@@ -185,12 +193,17 @@ func (t *Torrent) AddPeers(pp []Peer) {
 	cl.addPeers(t, pp)
 }
 
-// Marks the entire torrent for download. Requires the info first, see
-// GotInfo.
+// Marks the entire torrent for download, except files set to
+// FilePriorityNone. Requires the info first, see GotInfo.
 func (t *Torrent) DownloadAll() {
 	t.cl.mu.Lock()
 	defer t.cl.mu.Unlock()
 	t.pendPieceRange(0, t.numPieces())
+	for i, prio := range t.filePriorities {
+		if prio == FilePriorityNone {
+			t.setFilePriority(i, prio)
+		}
+	}
 }
 
 func (t *Torrent) String() string {
@@ -206,3 +219,29 @@ func (t *Torrent) AddTrackers(announceList [][]string) {
 	defer t.cl.mu.Unlock()
 	t.addTrackers(announceList)
 }
+
+// Sets the maximum bytes per second of piece data received from the
+// torrent's peers. This applies in addition to the Client's limit, so the lower
+// of the two takes effect. 0 or less removes the torrent's limit.
+func (t *Torrent) SetDownloadRateLimit(bytesPerSecond int64) {
+	t.downloadLimit.SetRate(bytesPerSecond)
+}
+
+// Returns the torrent's own download limit in bytes per second, or 0 if it
+// has none.
+func (t *Torrent) DownloadRateLimit() int64 {
+	return t.downloadLimit.Rate()
+}
+
+// Sets the maximum bytes per second of piece data sent to the torrent's
+// peers. This applies in addition to the Client's limit, so the lower of the
+// two takes effect. 0 or less removes the torrent's limit.
+func (t *Torrent) SetUploadRateLimit(bytesPerSecond int64) {
+	t.uploadLimit.SetRate(bytesPerSecond)
+}
+
+// Returns the torrent's own upload limit in bytes per second, or 0 if it has
+// none.
+func (t *Torrent) UploadRateLimit() int64 {
+	return t.uploadLimit.Rate()
+}
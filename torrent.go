@@ -11,6 +11,7 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -91,6 +92,57 @@ type Torrent struct {
 	completedPieces bitmap.Bitmap
 
 	connPieceInclinationPool sync.Pool
+
+	// Apply to piece data exchanged with this torrent's peers, in addition
+	// to the Client's limits.
+	uploadLimit   rateLimit
+	downloadLimit rateLimit
+
+	choker   choker
+	smartBan smartBan
+
+	stats ConnStats
+	// Traffic from previous sessions, as given in resume data.
+	prevSessionsStats ConnStats
+	// Recent payload rates.
+	downloadRate rollingRate
+	uploadRate   rollingRate
+
+	// Resume data that hasn't been applied yet because the info isn't
+	// available.
+	resume *ResumeData
+	// Priorities set on files, by file index.
+	filePriorities map[int]FilePriority
+}
+
+// Returns the offset and length of the file's data in the torrent.
+func (t *Torrent) fileRegion(index int) (off, length int64) {
+	for i, fi := range t.info.UpvertedFiles() {
+		if i == index {
+			length = fi.Length
+			return
+		}
+		off += fi.Length
+	}
+	panic(index)
+}
+
+func (t *Torrent) setFilePriority(index int, prio FilePriority) {
+	if prio == FilePriorityDefault {
+		delete(t.filePriorities, index)
+		return
+	}
+	if t.filePriorities == nil {
+		t.filePriorities = make(map[int]FilePriority)
+	}
+	t.filePriorities[index] = prio
+	off, length := t.fileRegion(index)
+	switch prio {
+	case FilePriorityNone:
+		t.unpendPieceRange(byteRegionExclusivePieces(off, length, t.info.PieceLength))
+	case FilePriorityNormal:
+		t.pendPieceRange(t.byteRegionPieces(off, length))
+	}
 }
 
 func (t *Torrent) setDisplayName(dn string) {
@@ -129,12 +181,15 @@ func (t *Torrent) addrActive(addr string) bool {
 
 func (t *Torrent) worstConns(cl *Client) (wcs *worstConns) {
 	wcs = &worstConns{
-		c:  make([]*connection, 0, len(t.conns)),
-		t:  t,
-		cl: cl,
+		c:       make([]*connection, 0, len(t.conns)),
+		t:       t,
+		cl:      cl,
+		ourIP:   cl.publicIP(),
+		ourPort: cl.incomingPeerPort(),
 	}
 	for _, c := range t.conns {
-		if !c.closed.IsSet() {
+		// Web seeds don't take up a socket, so there's no need to evict them.
+		if !c.closed.IsSet() && c.webSeed == nil {
 			wcs.c = append(wcs.c, c)
 		}
 	}
@@ -251,6 +306,7 @@ func (t *Torrent) setInfoBytes(b []byte) error {
 		t.updatePieceCompletion(i)
 		t.pieces[i].QueuedForHash = true
 	}
+	t.applyResumePieces()
 	go func() {
 		for i := range t.pieces {
 			t.verifyPiece(i)
@@ -435,9 +491,11 @@ func (t *Torrent) writeStatus(w io.Writer, cl *Client) {
 	fmt.Fprintf(w, "Half open: %d\n", len(t.halfOpen))
 	fmt.Fprintf(w, "Active peers: %d\n", len(t.conns))
 	sort.Sort(&worstConns{
-		c:  t.conns,
-		t:  t,
-		cl: cl,
+		c:       t.conns,
+		t:       t,
+		cl:      cl,
+		ourIP:   cl.publicIP(),
+		ourPort: cl.incomingPeerPort(),
 	})
 	for i, c := range t.conns {
 		fmt.Fprintf(w, "%2d. ", i+1)
@@ -454,8 +512,8 @@ func (t *Torrent) announceList() (al [][]string) {
 	return t.metainfo.AnnounceList
 }
 
-// Returns a run-time generated MetaInfo that includes the info bytes and
-// announce-list as currently known to the client.
+// Returns a run-time generated MetaInfo that includes the info bytes,
+// announce-list and web seeds as currently known to the client.
 func (t *Torrent) newMetaInfo() (mi *metainfo.MetaInfo) {
 	mi = &metainfo.MetaInfo{
 		CreationDate: time.Now().Unix(),
@@ -466,6 +524,15 @@ func (t *Torrent) newMetaInfo() (mi *metainfo.MetaInfo) {
 	if t.info != nil {
 		mi.Info = *t.info
 	}
+	for _, c := range t.conns {
+		switch {
+		case c.webSeed == nil:
+		case c.webSeed.httpSeed:
+			mi.HTTPSeeds = append(mi.HTTPSeeds, c.webSeed.url)
+		default:
+			mi.URLList = append(mi.URLList, c.webSeed.url)
+		}
+	}
 	return
 }
 
@@ -599,13 +666,13 @@ type Peer struct {
 	Id     [20]byte
 	IP     net.IP
 	Port   int
-	Source peerSource
+	Source PeerSource
 	// Peer is known to support encryption.
 	SupportsEncryption bool
 }
 
 func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", string(p.IP), p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.FormatInt(int64(p.Port), 10))
 }
 
 func (t *Torrent) pieceLength(piece int) (len_ pp.Integer) {
@@ -621,17 +688,28 @@ func (t *Torrent) pieceLength(piece int) (len_ pp.Integer) {
 	return
 }
 
-func (t *Torrent) hashPiece(piece int) (ret metainfo.Hash) {
+// Also returns the hash of each chunk in the piece if chunkHashes is set.
+func (t *Torrent) hashPiece(piece int, chunkHashes bool) (ret metainfo.Hash, chunks []metainfo.Hash) {
 	hash := pieceHash.New()
 	p := &t.pieces[piece]
 	p.waitNoPendingWrites()
 	ip := t.info.Piece(piece)
 	pl := ip.Length()
-	n, err := io.Copy(hash, io.NewSectionReader(t.pieces[piece].Storage(), 0, pl))
+	r := io.NewSectionReader(t.pieces[piece].Storage(), 0, pl)
+	var (
+		n   int64
+		err error
+	)
+	if chunkHashes {
+		n, chunks, err = copyHashingChunks(hash, r, pl, int64(t.chunkSize))
+	} else {
+		n, err = io.Copy(hash, r)
+	}
 	if n == pl {
 		missinggo.CopyExact(&ret, hash.Sum(nil))
 		return
 	}
+	chunks = nil
 	if err != io.ErrUnexpectedEOF && !os.IsNotExist(err) {
 		log.Printf("unexpected error hashing piece with %T: %s", t.storage, err)
 	}
@@ -1136,6 +1214,7 @@ func (t *Torrent) dropConnection(c *connection) {
 	t.cl.event.Broadcast()
 	c.Close()
 	if t.deleteConnection(c) {
+		t.rechoke()
 		t.openNewConns()
 	}
 }
@@ -1202,11 +1281,39 @@ func (t *Torrent) startMissingTrackerScrapers() {
 // values.
 func (t *Torrent) announceRequest() tracker.AnnounceRequest {
 	return tracker.AnnounceRequest{
-		Event:    tracker.None,
-		NumWant:  -1,
-		Port:     uint16(t.cl.incomingPeerPort()),
-		PeerId:   t.cl.peerID,
-		InfoHash: t.infoHash,
-		Left:     t.bytesLeftAnnounce(),
+		Event:      tracker.None,
+		NumWant:    -1,
+		Port:       uint16(t.cl.incomingPeerPort()),
+		PeerId:     t.cl.peerID,
+		InfoHash:   t.infoHash,
+		Left:       t.bytesLeftAnnounce(),
+		Uploaded:   t.stats.BytesWrittenData,
+		Downloaded: t.stats.BytesReadData,
+	}
+}
+
+func (t *Torrent) statsSnapshot() (ret TorrentStats) {
+	ret.Session = t.stats
+	ret.AllTime = t.prevSessionsStats
+	ret.AllTime.Add(t.stats)
+	ret.DownloadRate = t.downloadRate.Rate()
+	ret.UploadRate = t.uploadRate.Rate()
+	ret.ActivePeers = len(t.conns)
+	for _, c := range t.conns {
+		if c.webSeed == nil && missinggo.AddrIP(c.remoteAddr()).To4() == nil {
+			ret.ActivePeersIPv6++
+		}
+	}
+	return
+}
+
+// Updates the payload rates of the torrent and its connections. It should be
+// called every interval.
+func (t *Torrent) updateRates(interval time.Duration) {
+	for _, c := range t.conns {
+		c.downloadRate.update(c.stats.BytesReadData, interval)
+		c.uploadRate.update(c.stats.BytesWrittenData, interval)
 	}
+	t.downloadRate.update(t.stats.BytesReadData, interval)
+	t.uploadRate.update(t.stats.BytesWrittenData, interval)
 }
@@ -25,18 +25,25 @@ type httpResponse struct {
 	Complete      int32       `bencode:"complete"`
 	Incomplete    int32       `bencode:"incomplete"`
 	Peers         interface{} `bencode:"peers"`
+	// IPv6 peers, per http://www.bittorrent.org/beps/bep_0007.html.
+	Peers6 util.CompactIPv6Peers `bencode:"peers6"`
 }
 
 func (r *httpResponse) UnmarshalPeers() (ret []Peer, err error) {
-	s, ok := r.Peers.(string)
-	if !ok {
+	var cp []util.CompactPeer
+	switch v := r.Peers.(type) {
+	case string:
+		cp, err = util.UnmarshalIPv4CompactPeers([]byte(v))
+		if err != nil {
+			return
+		}
+	case nil:
+		// Some trackers only give peers6.
+	default:
 		err = fmt.Errorf("unsupported peers value type: %T", r.Peers)
 		return
 	}
-	cp, err := util.UnmarshalIPv4CompactPeers([]byte(s))
-	if err != nil {
-		return
-	}
+	cp = append(cp, r.Peers6...)
 	ret = make([]Peer, 0, len(cp))
 	for _, p := range cp {
 		ret = append(ret, Peer{net.IP(p.IP[:]), int(p.Port)})
@@ -0,0 +1,35 @@
+package tracker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/bencode"
+)
+
+func TestUnmarshalHTTPResponsePeers6(t *testing.T) {
+	var hr httpResponse
+	require.NoError(t, bencode.Unmarshal([]byte(
+		"d5:peers6:\x01\x02\x03\x04\x00\x506:peers618:"+
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e",
+	), &hr))
+	ps, err := hr.UnmarshalPeers()
+	require.NoError(t, err)
+	require.Len(t, ps, 2)
+	assert.Equal(t, "1.2.3.4", ps[0].IP.String())
+	assert.EqualValues(t, 80, ps[0].Port)
+	assert.Equal(t, "2001:db8::1", ps[1].IP.String())
+	assert.EqualValues(t, 6881, ps[1].Port)
+}
+
+func TestUnmarshalHTTPResponseOnlyPeers6(t *testing.T) {
+	var hr httpResponse
+	require.NoError(t, bencode.Unmarshal([]byte(
+		"d6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e",
+	), &hr))
+	ps, err := hr.UnmarshalPeers()
+	require.NoError(t, err)
+	assert.Len(t, ps, 1)
+}
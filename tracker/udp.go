@@ -115,7 +115,14 @@ func (c *udpAnnounce) Do(req *AnnounceRequest) (res AnnounceResponse, err error)
 	res.Interval = h.Interval
 	res.Leechers = h.Leechers
 	res.Seeders = h.Seeders
-	cps, err := util.UnmarshalIPv4CompactPeers(b.Bytes())
+	// Trackers reached over IPv6 give IPv6 peers, per
+	// http://www.bittorrent.org/beps/bep_0015.html.
+	var cps []util.CompactPeer
+	if missinggo.AddrIP(c.socket.RemoteAddr()).To4() == nil {
+		cps, err = util.UnmarshalIPv6CompactPeers(b.Bytes())
+	} else {
+		cps, err = util.UnmarshalIPv4CompactPeers(b.Bytes())
+	}
 	if err != nil {
 		return
 	}
@@ -24,7 +24,7 @@ func trackerToTorrentPeers(ps []tracker.Peer) (ret []Peer) {
 		ret = append(ret, Peer{
 			IP:     p.IP,
 			Port:   p.Port,
-			Source: peerSourceTracker,
+			Source: PeerSourceTracker,
 		})
 	}
 	return
@@ -65,7 +65,9 @@ func (me *trackerScraper) announceEvent(event tracker.AnnounceEvent) {
 		log.Printf("error preparing announce to %q: %s", me.url, err)
 		return
 	}
+	me.t.cl.mu.Lock()
 	req := me.t.announceRequest()
+	me.t.cl.mu.Unlock()
 	req.Event = event
 	_, err = tracker.AnnounceHost(urlToUse, &req, host)
 	if err != nil {
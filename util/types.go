@@ -19,6 +19,7 @@ var (
 	// This allows bencode.Unmarshal to do better than a string or []byte.
 	_ bencode.Unmarshaler      = &CompactIPv4Peers{}
 	_ encoding.BinaryMarshaler = CompactIPv4Peers{}
+	_ bencode.Marshaler        = CompactIPv4Peers{}
 )
 
 // This allows bencode.Unmarshal to do better than a string or []byte.
@@ -41,6 +42,50 @@ func (cps CompactIPv4Peers) MarshalBinary() (ret []byte, err error) {
 	return
 }
 
+func (cps CompactIPv4Peers) MarshalBencode() ([]byte, error) {
+	b, err := cps.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bencode.Marshal(b)
+}
+
+// Concatenated 18-byte peer addresses.
+type CompactIPv6Peers []CompactPeer
+
+var (
+	_ bencode.Unmarshaler      = &CompactIPv6Peers{}
+	_ encoding.BinaryMarshaler = CompactIPv6Peers{}
+	_ bencode.Marshaler        = CompactIPv6Peers{}
+)
+
+func (cps *CompactIPv6Peers) UnmarshalBencode(b []byte) (err error) {
+	var bb []byte
+	err = bencode.Unmarshal(b, &bb)
+	if err != nil {
+		return
+	}
+	*cps, err = UnmarshalIPv6CompactPeers(bb)
+	return
+}
+
+func (cps CompactIPv6Peers) MarshalBinary() (ret []byte, err error) {
+	ret = make([]byte, len(cps)*18)
+	for i, cp := range cps {
+		copy(ret[18*i:], cp.IP.To16())
+		binary.BigEndian.PutUint16(ret[18*i+16:], uint16(cp.Port))
+	}
+	return
+}
+
+func (cps CompactIPv6Peers) MarshalBencode() ([]byte, error) {
+	b, err := cps.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bencode.Marshal(b)
+}
+
 // Represents peer address in either IPv6 or IPv4 form.
 type CompactPeer struct {
 	IP   net.IP
@@ -88,15 +133,23 @@ func (cp *CompactPeer) UnmarshalBencode(b []byte) (err error) {
 }
 
 func UnmarshalIPv4CompactPeers(b []byte) (ret []CompactPeer, err error) {
-	if len(b)%6 != 0 {
+	return unmarshalCompactPeers(b, 6)
+}
+
+func UnmarshalIPv6CompactPeers(b []byte) (ret []CompactPeer, err error) {
+	return unmarshalCompactPeers(b, 18)
+}
+
+func unmarshalCompactPeers(b []byte, size int) (ret []CompactPeer, err error) {
+	if len(b)%size != 0 {
 		err = errors.New("bad length")
 		return
 	}
-	num := len(b) / 6
+	num := len(b) / size
 	ret = make([]CompactPeer, num)
 	for i := range iter.N(num) {
-		off := i * 6
-		err = ret[i].UnmarshalBinary(b[off : off+6])
+		off := i * size
+		err = ret[i].UnmarshalBinary(b[off : off+size])
 		if err != nil {
 			return
 		}
@@ -0,0 +1,336 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lovedboy/torrent/metainfo"
+	pp "github.com/lovedboy/torrent/peer_protocol"
+)
+
+// A BEP 19 web seed. It's driven as a connection to a peer that has every
+// piece, so it shares the piece picker and hash checking with real peers.
+// Requests posted to the connection are served by HTTP range requests.
+type webSeed struct {
+	url    string
+	client *http.Client
+	// Requests use the BEP 17 protocol, rather than BEP 19.
+	httpSeed bool
+}
+
+// Used by web seeds, so that stalled servers don't hold up requests forever.
+var webSeedHTTPClient = &http.Client{Timeout: webSeedRequestTimeout}
+
+// The net.Addr of a web seed connection. It's not an IP address.
+type webSeedAddr string
+
+func (me webSeedAddr) Network() string { return "http" }
+func (me webSeedAddr) String() string  { return string(me) }
+
+// Adds web seeds by URL, per http://www.bittorrent.org/beps/bep_0019.html.
+func (t *Torrent) AddWebSeeds(urls []string) {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.addWebSeeds(urls)
+}
+
+func (t *Torrent) addWebSeeds(urls []string) {
+	for _, u := range urls {
+		t.addWebSeed(u, false)
+	}
+}
+
+func (t *Torrent) addWebSeed(u string, httpSeed bool) {
+	if t.closed.IsSet() {
+		return
+	}
+	for _, c := range t.conns {
+		if c.webSeed != nil && c.webSeed.url == u && c.webSeed.httpSeed == httpSeed {
+			return
+		}
+	}
+	c := &connection{
+		t: t,
+		webSeed: &webSeed{
+			url:      u,
+			client:   webSeedHTTPClient,
+			httpSeed: httpSeed,
+		},
+		Discovery:          PeerSourceWebSeed,
+		Choked:             true,
+		PeerMaxRequests:    webSeedMaxRequests,
+		peerHasAll:         true,
+		completedHandshake: time.Now(),
+	}
+	t.conns = append(t.conns, c)
+	c.peerPiecesChanged()
+	go c.webSeedLoop()
+}
+
+// The number of connections that count against socketsPerTorrent. Web seeds
+// don't.
+func (t *Torrent) numPeerConns() (ret int) {
+	for _, c := range t.conns {
+		if c.webSeed == nil {
+			ret++
+		}
+	}
+	return
+}
+
+// Returns the URL for a file in the torrent. A URL ending in "/" is a
+// directory containing the torrent's data, otherwise it's the file itself
+// for single-file torrents.
+func (ws *webSeed) fileURL(info *metainfo.Info, fi metainfo.FileInfo) string {
+	if !info.IsDir() {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + escapePath(info.Name)
+		}
+		return ws.url
+	}
+	ret := ws.url
+	if !strings.HasSuffix(ret, "/") {
+		ret += "/"
+	}
+	ret += escapePath(info.Name)
+	for _, p := range fi.Path {
+		ret += "/" + escapePath(p)
+	}
+	return ret
+}
+
+func escapePath(s string) string {
+	return (&url.URL{Path: s}).EscapedPath()
+}
+
+// A contiguous range of torrent data covering one or more requests.
+type webSeedSpan struct {
+	off, length int64
+	requests    []request
+}
+
+// Merges requests into spans of contiguous data. If splitPieces is set, spans
+// don't cross piece boundaries.
+func (t *Torrent) webSeedSpans(rs []request, splitPieces bool) (ret []webSeedSpan) {
+	sort.Sort(requestsByOffset{rs, t})
+	for _, r := range rs {
+		off := t.requestOffset(r)
+		if n := len(ret); n != 0 && ret[n-1].off+ret[n-1].length == off &&
+			(!splitPieces || ret[n-1].requests[0].Index == r.Index) {
+			ret[n-1].length += int64(r.Length)
+			ret[n-1].requests = append(ret[n-1].requests, r)
+			continue
+		}
+		ret = append(ret, webSeedSpan{off, int64(r.Length), []request{r}})
+	}
+	return
+}
+
+type requestsByOffset struct {
+	rs []request
+	t  *Torrent
+}
+
+func (me requestsByOffset) Len() int      { return len(me.rs) }
+func (me requestsByOffset) Swap(i, j int) { me.rs[i], me.rs[j] = me.rs[j], me.rs[i] }
+func (me requestsByOffset) Less(i, j int) bool {
+	return me.t.requestOffset(me.rs[i]) < me.t.requestOffset(me.rs[j])
+}
+
+// Fills b with the data for the span.
+func (ws *webSeed) readSpan(ctx context.Context, ih metainfo.Hash, info *metainfo.Info, b []byte, s webSeedSpan) error {
+	if ws.httpSeed {
+		r := s.requests[0]
+		return ws.getPieceRange(ctx, ih, int(r.Index), b, int64(r.Begin))
+	}
+	_, err := ws.readAt(ctx, info, b, s.off)
+	return err
+}
+
+// Reads the torrent data in [off, off+len(b)) from the web seed. The range
+// can span several files.
+func (ws *webSeed) readAt(ctx context.Context, info *metainfo.Info, b []byte, off int64) (n int64, err error) {
+	var fileOff int64
+	for _, fi := range info.UpvertedFiles() {
+		if off >= fileOff+fi.Length {
+			fileOff += fi.Length
+			continue
+		}
+		if len(b) == 0 {
+			break
+		}
+		m := fileOff + fi.Length - off
+		if m > int64(len(b)) {
+			m = int64(len(b))
+		}
+		err = ws.get(ctx, ws.fileURL(info, fi), b[:m], off-fileOff)
+		if err != nil {
+			return
+		}
+		b = b[m:]
+		n += m
+		off += m
+		fileOff += fi.Length
+	}
+	if len(b) != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// Fills b from the resource at the URL, starting at off.
+func (ws *webSeed) get(ctx context.Context, u string, b []byte, off int64) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, b)
+	return err
+}
+
+// Takes the requests posted to the web seed since the last call. Other
+// messages have no meaning for a web seed and are discarded.
+func (cn *connection) takeWebSeedRequests() (ret []request) {
+	for cn.outgoingUnbufferedMessages != nil && cn.outgoingUnbufferedMessages.Len() != 0 {
+		msg := cn.outgoingUnbufferedMessages.Remove(cn.outgoingUnbufferedMessages.Front()).(pp.Message)
+		if !msg.Keepalive && msg.Type == pp.Request {
+			ret = append(ret, newRequest(msg.Index, msg.Begin, msg.Length))
+		}
+	}
+	cn.outgoingUnbufferedMessagesNotEmpty.Clear()
+	return
+}
+
+var errWebSeedClosed = errors.New("web seed closed")
+
+// Serves requests posted to a web seed connection until it's closed.
+func (cn *connection) webSeedLoop() {
+	t := cn.t
+	// Abandons outstanding HTTP requests when the connection is closed, such
+	// as when the torrent is dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cn.closed.LockedChan(cn.mu()):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		cn.mu().Lock()
+		rs := cn.takeWebSeedRequests()
+		cn.mu().Unlock()
+		if len(rs) == 0 {
+			select {
+			case <-cn.closed.LockedChan(cn.mu()):
+				return
+			case <-cn.outgoingUnbufferedMessagesNotEmpty.LockedChan(cn.mu()):
+			}
+			continue
+		}
+		cn.mu().Lock()
+		spans := t.webSeedSpans(rs, cn.webSeed.httpSeed)
+		info := &t.info.Info
+		cn.mu().Unlock()
+		for _, s := range spans {
+			err := cn.webSeedFetch(ctx, info, s)
+			if err == errWebSeedClosed || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("%s: web seed %q: %s", t, cn.webSeed.url, err)
+				retry := webSeedRetryInterval
+				if ra, ok := err.(retryAfterError); ok {
+					retry = ra.wait
+				}
+				if !cn.webSeedBackoff(retry) {
+					return
+				}
+				break
+			}
+		}
+	}
+}
+
+// Downloads a span and hands each chunk to the client as if it arrived from
+// a peer.
+func (cn *connection) webSeedFetch(ctx context.Context, info *metainfo.Info, s webSeedSpan) error {
+	t := cn.t
+	cl := t.cl
+	b := make([]byte, s.length)
+	err := cn.webSeed.readSpan(ctx, t.infoHash, info, b, s)
+	if err != nil {
+		return err
+	}
+	for _, r := range s.requests {
+		data := b[:r.Length]
+		b = b[r.Length:]
+		waitRateLimits(int64(len(data)), &cl.downloadLimit, &t.downloadLimit)
+		cl.mu.Lock()
+		if cl.closed.IsSet() || cn.closed.IsSet() {
+			cl.mu.Unlock()
+			return errWebSeedClosed
+		}
+		// Only the payload is counted, HTTP overhead isn't seen.
+		cn.readBytes(int64(len(data)))
+		msg := pp.Message{
+			Type:  pp.Piece,
+			Index: r.Index,
+			Begin: r.Begin,
+			Piece: data,
+		}
+		cn.readMsg(&msg)
+		cn.lastMessageReceived = time.Now()
+		cl.downloadedChunk(t, cn, &msg)
+		cl.mu.Unlock()
+	}
+	return nil
+}
+
+// Stops requesting from the web seed for a while after an error, like being
+// choked by a peer. Returns false if the connection closed meanwhile.
+func (cn *connection) webSeedBackoff(d time.Duration) bool {
+	cn.mu().Lock()
+	cn.PeerChoked = true
+	cn.Requests = nil
+	cn.takeWebSeedRequests()
+	cn.updateRequests()
+	cn.mu().Unlock()
+	select {
+	case <-cn.closed.LockedChan(cn.mu()):
+		return false
+	case <-time.After(d):
+	}
+	cn.mu().Lock()
+	defer cn.mu().Unlock()
+	cn.PeerChoked = false
+	cn.t.cl.peerUnchoked(cn.t, cn)
+	return true
+}
@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lovedboy/torrent/internal/testutil"
+	"github.com/lovedboy/torrent/metainfo"
+)
+
+func TestWebSeedFileURL(t *testing.T) {
+	single := &metainfo.Info{Name: "a b", Length: 1}
+	multi := &metainfo.Info{Name: "dir", Files: []metainfo.FileInfo{
+		{Length: 1, Path: []string{"sub", "c#d"}},
+	}}
+	ws := webSeed{url: "http://host/path/"}
+	assert.Equal(t, "http://host/path/a%20b", ws.fileURL(single, single.UpvertedFiles()[0]))
+	assert.Equal(t, "http://host/path/dir/sub/c%23d", ws.fileURL(multi, multi.Files[0]))
+	ws = webSeed{url: "http://host/file"}
+	assert.Equal(t, "http://host/file", ws.fileURL(single, single.UpvertedFiles()[0]))
+	assert.Equal(t, "http://host/file/dir/sub/c%23d", ws.fileURL(multi, multi.Files[0]))
+}
+
+func TestWebSeedReadAcrossFiles(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := map[string]string{
+			"/dir/a": "hello, ",
+			"/dir/b": "world\n",
+		}[r.URL.Path]
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer s.Close()
+	info := &metainfo.Info{Name: "dir", Files: []metainfo.FileInfo{
+		{Length: 7, Path: []string{"a"}},
+		{Length: 6, Path: []string{"b"}},
+	}}
+	ws := webSeed{url: s.URL, client: webSeedHTTPClient}
+	b := make([]byte, 8)
+	n, err := ws.readAt(context.Background(), info, b, 3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 8, n)
+	assert.Equal(t, "lo, worl", string(b))
+	_, err = ws.readAt(context.Background(), info, make([]byte, 4), 11)
+	assert.Error(t, err)
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	greetingTempDir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingTempDir)
+	s := httptest.NewServer(http.FileServer(http.Dir(greetingTempDir)))
+	defer s.Close()
+	cfg := TestingConfig
+	var err error
+	cfg.DataDir, err = ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(cfg.DataDir)
+	cl, err := NewClient(&cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(mi)
+	spec.ChunkSize = 2
+	spec.Webseeds = []string{s.URL + "/"}
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	pcs := tt.PeerConns()
+	require.Len(t, pcs, 1)
+	assert.Equal(t, "http", pcs[0].Transport)
+	assert.Equal(t, PeerSourceWebSeed, pcs[0].Source)
+	r := tt.NewReader()
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.EqualValues(t, testutil.GreetingFileContents, b)
+	assert.EqualValues(t, len(testutil.GreetingFileContents), tt.Stats().Session.BytesReadData)
+}
+
+// Web seeds are passed over when dropping the connections of a peer banned
+// for a bad piece. Their addresses are URLs, which may include a port.
+func TestSmartBanWithWebSeed(t *testing.T) {
+	cl, err := NewClient(&TestingConfig)
+	require.NoError(t, err)
+	defer cl.Close()
+	ie := metainfo.InfoEx{
+		Info: metainfo.Info{
+			PieceLength: 1,
+			Pieces:      make([]byte, 20),
+			Files:       []metainfo.FileInfo{{Length: 1}},
+		},
+	}
+	ie.UpdateBytes()
+	tt, _, err := cl.AddTorrentSpec(&TorrentSpec{
+		Info:     &ie,
+		InfoHash: ie.Hash(),
+		Webseeds: []string{"http://127.0.0.1:1/"},
+	})
+	require.NoError(t, err)
+	defer tt.Drop()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	require.Len(t, tt.conns, 1)
+	ip := net.IPv4(1, 2, 3, 4)
+	tt.smartBan.record(0, 0, ip, []byte{1})
+	cl.pieceHashed(tt, 0, false, nil)
+	assert.True(t, cl.badPeerIPPort(ip, 1234))
+	assert.Len(t, tt.conns, 1)
+}
@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"net"
 	"time"
 )
 
@@ -9,6 +10,10 @@ type worstConns struct {
 	c  []*connection
 	t  *Torrent
 	cl *Client
+	// Our IP and listen port for BEP 40 priorities, resolved once rather
+	// than for every comparison.
+	ourIP   net.IP
+	ourPort int
 }
 
 func (wc *worstConns) Len() int      { return len(wc.c) }
@@ -29,7 +34,10 @@ func (wc *worstConns) Push(x interface{}) {
 type worstConnsSortKey struct {
 	useful      bool
 	lastHelpful time.Time
-	connected   time.Time
+	// BEP 40 priority, so connections that haven't helped are dropped in
+	// canonical order.
+	priority  peerPriority
+	connected time.Time
 }
 
 func (wc worstConnsSortKey) Less(other worstConnsSortKey) bool {
@@ -39,6 +47,9 @@ func (wc worstConnsSortKey) Less(other worstConnsSortKey) bool {
 	if !wc.lastHelpful.Equal(other.lastHelpful) {
 		return wc.lastHelpful.Before(other.lastHelpful)
 	}
+	if wc.priority != other.priority {
+		return wc.priority < other.priority
+	}
 	return wc.connected.Before(other.connected)
 }
 
@@ -53,6 +64,7 @@ func (wc *worstConns) key(i int) (key worstConnsSortKey) {
 	if c.lastUsefulChunkReceived.After(key.lastHelpful) {
 		key.lastHelpful = c.lastUsefulChunkReceived
 	}
+	key.priority = c.peerPriority(wc.ourIP, wc.ourPort)
 	key.connected = c.completedHandshake
 	return
 }